@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 設定はデフォルト < 設定ファイル (JSON) < 環境変数 < フラグ の順に上書きする。
+// 環境変数は ISU_ にフラグ名を大文字にして - を _ にしたもの (listen なら ISU_LISTEN)
+var cfg = defaultConfig()
+
+type config struct {
+	Listen      string   `json:"listen"`
+	PprofListen string   `json:"pprof_listen"` // 空なら pprof も管理 API も立てない
+	DB          dbConfig `json:"db"`
+
+	Storage string `json:"storage"` // csv, kv, memory
+	DataDir string `json:"data_dir"`
+
+	Hosts    []string `json:"hosts"`
+	SelfHost string   `json:"self_host"`
+	NotOwner string   `json:"not_owner"` // reject, redirect, proxy
+
+	Items             string `json:"items"`
+	PrecomputeItems   int    `json:"precompute_items"` // 負なら前計算しない
+	AddRate           int64  `json:"add_rate"`
+	RoomAddRate       int64  `json:"room_add_rate"`
+	SellRefundPercent int64  `json:"sell_refund_percent"`
+
+	RoomTTL          duration `json:"room_ttl"`
+	StatusInterval   duration `json:"status_interval"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+	SimulationWindow int64    `json:"simulation_window"` // ミリ秒
+	ShutdownTimeout  duration `json:"shutdown_timeout"`
+
+	Trace string    `json:"trace"`
+	Log   logConfig `json:"log"`
+}
+
+type dbConfig struct {
+	Host            string   `json:"host"`
+	Port            string   `json:"port"`
+	User            string   `json:"user"`
+	Password        string   `json:"password"`
+	MaxOpenConns    int      `json:"max_open_conns"`
+	ConnMaxLifetime duration `json:"conn_max_lifetime"`
+}
+
+// JSON では "500ms" や "24h" のように書く
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:      ":5000",
+		PprofListen: ":3000",
+		DB: dbConfig{
+			Host:            "127.0.0.1",
+			Port:            "3306",
+			User:            "root",
+			MaxOpenConns:    20,
+			ConnMaxLifetime: duration{5 * time.Minute},
+		},
+		Storage:           "csv",
+		DataDir:           "/home/isucon",
+		Hosts:             defaultHostnames,
+		NotOwner:          "reject",
+		PrecomputeItems:   -1,
+		AddRate:           addRate,
+		RoomAddRate:       roomAddRate,
+		SellRefundPercent: sellRefundPercent,
+		RoomTTL:           duration{roomTTL},
+		StatusInterval:    duration{statusInterval},
+		SnapshotInterval:  duration{snapshotInterval},
+		SimulationWindow:  simulationWindow,
+		ShutdownTimeout:   duration{10 * time.Second},
+		Log:               logs.config(),
+	}
+}
+
+// フラグと環境変数で変えられるもの
+type configKey struct {
+	name string
+	help string
+	set  func(c *config, v string) error
+}
+
+func setString(p func(c *config) *string) func(*config, string) error {
+	return func(c *config, v string) error {
+		*p(c) = v
+		return nil
+	}
+}
+
+func setInt(p func(c *config) *int) func(*config, string) error {
+	return func(c *config, v string) error {
+		n, err := strconv.Atoi(v)
+		*p(c) = n
+		return err
+	}
+}
+
+func setInt64(p func(c *config) *int64) func(*config, string) error {
+	return func(c *config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		*p(c) = n
+		return err
+	}
+}
+
+func setDuration(p func(c *config) *duration) func(*config, string) error {
+	return func(c *config, v string) error {
+		d, err := time.ParseDuration(v)
+		p(c).Duration = d
+		return err
+	}
+}
+
+var configKeys = []configKey{
+	{"listen", "ゲームの HTTP を listen するアドレス", setString(func(c *config) *string { return &c.Listen })},
+	{"pprof-listen", "pprof と /healthz、管理 API を listen するアドレス", setString(func(c *config) *string { return &c.PprofListen })},
+	{"db-host", "MySQL のホスト", setString(func(c *config) *string { return &c.DB.Host })},
+	{"db-port", "MySQL のポート", setString(func(c *config) *string { return &c.DB.Port })},
+	{"db-user", "MySQL のユーザ", setString(func(c *config) *string { return &c.DB.User })},
+	{"db-password", "MySQL のパスワード", setString(func(c *config) *string { return &c.DB.Password })},
+	{"db-max-open-conns", "MySQL の最大接続数", setInt(func(c *config) *int { return &c.DB.MaxOpenConns })},
+	{"db-conn-max-lifetime", "MySQL の接続を使い回す時間", setDuration(func(c *config) *duration { return &c.DB.ConnMaxLifetime })},
+	{"storage", "csv, kv, memory", setString(func(c *config) *string { return &c.Storage })},
+	{"data-dir", "que.csv, adding.log などを置くディレクトリ", setString(func(c *config) *string { return &c.DataDir })},
+	{"hosts", "ring のホスト (カンマ区切り)", func(c *config, v string) error {
+		c.Hosts = parseHosts(v)
+		return nil
+	}},
+	{"self-host", "このサーバの ring 上の名前", setString(func(c *config) *string { return &c.SelfHost })},
+	{"not-owner", "担当でない部屋の接続: reject, redirect, proxy", setString(func(c *config) *string { return &c.NotOwner })},
+	{"items", "アイテムのマスタ: 空, db, JSON ファイルのパス", setString(func(c *config) *string { return &c.Items })},
+	{"precompute-items", "起動時に count がここまでの Power と Price を計算しておく", setInt(func(c *config) *int { return &c.PrecomputeItems })},
+	{"add-rate", "接続ごとの addIsu の上限 (isu/秒, 0 で無制限)", setInt64(func(c *config) *int64 { return &c.AddRate })},
+	{"room-add-rate", "部屋ごとの addIsu の上限 (isu/秒, 0 で無制限)", setInt64(func(c *config) *int64 { return &c.RoomAddRate })},
+	{"sell-refund-percent", "sellItem で返す Price の割合", setInt64(func(c *config) *int64 { return &c.SellRefundPercent })},
+	{"room-ttl", "何もされなかった部屋を片付けるまでの時間 (0 で片付けない)", setDuration(func(c *config) *duration { return &c.RoomTTL })},
+	{"status-interval", "GameStatus を配る間隔", setDuration(func(c *config) *duration { return &c.StatusInterval })},
+	{"snapshot-interval", "スナップショットを書く間隔", setDuration(func(c *config) *duration { return &c.SnapshotInterval })},
+	{"simulation-window", "GameStatus で何ミリ秒先まで計算するか", setInt64(func(c *config) *int64 { return &c.SimulationWindow })},
+	{"shutdown-timeout", "SIGTERM のあと接続が切れるのを待つ時間", setDuration(func(c *config) *duration { return &c.ShutdownTimeout })},
+	{"trace", "トレースの出力先: file:PATH か http://...", setString(func(c *config) *string { return &c.Trace })},
+	{"log-level", "debug, info, warn, error", setString(func(c *config) *string { return &c.Log.Level })},
+	{"log-format", "json, text", setString(func(c *config) *string { return &c.Log.Format })},
+	{"log-sample-first", "info 以下の同じメッセージを1秒に何件まで出すか", setInt(func(c *config) *int { return &c.Log.SampleFirst })},
+	{"log-sample-thereafter", "超えた分を何件に1件出すか", setInt(func(c *config) *int { return &c.Log.SampleThereafter })},
+}
+
+func (k configKey) env() string {
+	return "ISU_" + strings.ToUpper(strings.Replace(k.name, "-", "_", -1))
+}
+
+// フラグで指定された値。全部読んでから環境変数の後に当てる
+type flagValue struct {
+	key   configKey
+	value *string
+}
+
+func (f flagValue) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f flagValue) Set(v string) error {
+	*f.value = v
+	return nil
+}
+
+// args は os.Args[1:]。printConfig は --print-config のとき true になる
+func loadConfig(args []string, getenv func(string) string, stderr io.Writer) (c *config, printConfig bool, err error) {
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("config", getenv("ISU_CONFIG"), "設定ファイル (JSON)。環境変数は ISU_CONFIG")
+	fs.BoolVar(&printConfig, "print-config", false, "設定を JSON で出力して終わる")
+	values := map[string]*string{}
+	for _, k := range configKeys {
+		values[k.name] = new(string)
+		fs.Var(flagValue{k, values[k.name]}, k.name, k.help+" (環境変数は "+k.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	c = defaultConfig()
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, false, err
+		}
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, false, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+	for _, k := range configKeys {
+		if v := getenv(k.env()); v != "" {
+			if err := k.set(c, v); err != nil {
+				return nil, false, fmt.Errorf("%s: %v", k.env(), err)
+			}
+		}
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, k := range configKeys {
+		if set[k.name] {
+			if err := k.set(c, *values[k.name]); err != nil {
+				return nil, false, fmt.Errorf("-%s: %v", k.name, err)
+			}
+		}
+	}
+	return c, printConfig, c.validate()
+}
+
+func (c *config) validate() error {
+	errs := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Listen != "", "listen is required")
+	check(c.Listen != c.PprofListen, "listen and pprof_listen must differ")
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns must be positive")
+	check(c.DB.ConnMaxLifetime.Duration >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.Storage == "csv" || c.Storage == "kv" || c.Storage == "memory", "unknown storage: %q", c.Storage)
+	check(c.Storage == "memory" || c.DataDir != "", "data_dir is required")
+	check(len(c.Hosts) > 0, "hosts is required")
+	if c.SelfHost != "" {
+		found := false
+		for _, h := range c.Hosts {
+			found = found || h == c.SelfHost
+		}
+		check(found, "self_host %q is not in hosts", c.SelfHost)
+	}
+	check(c.NotOwner == "reject" || c.NotOwner == "redirect" || c.NotOwner == "proxy", "unknown not_owner: %q", c.NotOwner)
+	check(c.AddRate >= 0 && c.RoomAddRate >= 0, "add rates must not be negative")
+	check(0 <= c.SellRefundPercent && c.SellRefundPercent <= 100, "sell_refund_percent must be in 0..100")
+	check(c.RoomTTL.Duration >= 0, "room_ttl must not be negative")
+	check(c.StatusInterval.Duration > 0, "status_interval must be positive")
+	check(c.SnapshotInterval.Duration > 0, "snapshot_interval must be positive")
+	check(c.SimulationWindow > 0, "simulation_window must be positive")
+	check(c.ShutdownTimeout.Duration > 0, "shutdown_timeout must be positive")
+	if c.Trace != "" {
+		check(strings.HasPrefix(c.Trace, "file:") || strings.HasPrefix(c.Trace, "http://") || strings.HasPrefix(c.Trace, "https://"),
+			"trace must start with file: or http://")
+	}
+	if err := newLogger(ioutil.Discard).setConfig(c.Log); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// パスワードは伏せて出す
+func (c *config) print(w io.Writer) {
+	x := *c
+	if x.DB.Password != "" {
+		x.DB.Password = "********"
+	}
+	b, _ := json.MarshalIndent(x, "", "  ")
+	fmt.Fprintln(w, string(b))
+}
+
+// 起動時に1回だけ呼ぶ。ここで設定したグローバル変数は起動後は変えない
+func (c *config) apply() error {
+	ring = newHashRing(c.Hosts)
+	selfHost = c.SelfHost
+	notOwnerMode = c.NotOwner
+	itemsSource = c.Items
+	addRate = c.AddRate
+	roomAddRate = c.RoomAddRate
+	sellRefundPercent = c.SellRefundPercent
+	roomTTL = c.RoomTTL.Duration
+	statusInterval = c.StatusInterval.Duration
+	snapshotInterval = c.SnapshotInterval.Duration
+	simulationWindow = c.SimulationWindow
+	return logs.setConfig(c.Log)
+}
+
+func initConfig() {
+	c, printConfig, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if printConfig && c != nil {
+		c.print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		os.Exit(0)
+	}
+	cfg = c
+	if err := cfg.apply(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envMap(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	assert.Nil(ioutil.WriteFile(path, []byte(`{
+		"listen": ":6000",
+		"storage": "memory",
+		"db": {"host": "db.local", "port": "3307"},
+		"status_interval": "200ms",
+		"hosts": ["a", "b"],
+		"log": {"level": "warn"}
+	}`), 0644))
+
+	env := envMap(map[string]string{
+		"ISU_CONFIG":      path,
+		"ISU_LISTEN":      ":7000",
+		"ISU_DB_PORT":     "3308",
+		"ISU_SELF_HOST":   "b",
+		"ISU_ROOM_TTL":    "1h",
+		"ISU_NOT_OWNER":   "proxy",
+		"ISU_DB_PASSWORD": "secret",
+	})
+	c, printConfig, err := loadConfig([]string{"-listen", ":8000", "-simulation-window=2000"}, env, ioutil.Discard)
+	assert.Nil(err)
+	assert.False(printConfig)
+
+	// フラグ > 環境変数 > ファイル > デフォルト
+	assert.Equal(":8000", c.Listen)
+	assert.Equal("3308", c.DB.Port)
+	assert.Equal("db.local", c.DB.Host)
+	assert.Equal("root", c.DB.User)
+	assert.Equal("memory", c.Storage)
+	assert.Equal([]string{"a", "b"}, c.Hosts)
+	assert.Equal("b", c.SelfHost)
+	assert.Equal("proxy", c.NotOwner)
+	assert.Equal(200*time.Millisecond, c.StatusInterval.Duration)
+	assert.Equal(time.Hour, c.RoomTTL.Duration)
+	assert.Equal(int64(2000), c.SimulationWindow)
+	assert.Equal(10*time.Second, c.SnapshotInterval.Duration)
+	assert.Equal("warn", c.Log.Level)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	load := func(args []string, env map[string]string) error {
+		_, _, err := loadConfig(args, envMap(env), ioutil.Discard)
+		return err
+	}
+
+	assert.Nil(load(nil, nil))
+	assert.NotNil(load([]string{"-add-rate", "x"}, nil))
+	assert.NotNil(load(nil, map[string]string{"ISU_ROOM_TTL": "1"}))
+	assert.NotNil(load(nil, map[string]string{"ISU_CONFIG": "/nonexistent/config.json"}))
+
+	err := load([]string{"-storage", "s3", "-sell-refund-percent", "150", "-status-interval", "0s"}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "unknown storage")
+	assert.Contains(err.Error(), "sell_refund_percent")
+	assert.Contains(err.Error(), "status_interval")
+
+	assert.NotNil(load([]string{"-hosts", "a,b", "-self-host", "c"}, nil))
+	assert.NotNil(load([]string{"-not-owner", "drop"}, nil))
+	assert.NotNil(load([]string{"-log-level", "trace"}, nil))
+	assert.NotNil(load([]string{"-trace", "udp://x"}, nil))
+	assert.NotNil(load([]string{"-listen", ":3000"}, nil))
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	assert := assert.New(t)
+	f, err := ioutil.TempFile("", "config")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"lisen": ":5001"}`)
+	f.Close()
+
+	_, _, err = loadConfig([]string{"-config", f.Name()}, envMap(nil), ioutil.Discard)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "lisen")
+}
+
+func TestPrintConfig(t *testing.T) {
+	assert := assert.New(t)
+	c, printConfig, err := loadConfig([]string{"--print-config", "-db-password", "secret"}, envMap(nil), ioutil.Discard)
+	assert.Nil(err)
+	assert.True(printConfig)
+
+	var b bytes.Buffer
+	c.print(&b)
+	assert.False(strings.Contains(b.String(), "secret"))
+
+	var printed config
+	assert.Nil(json.Unmarshal(b.Bytes(), &printed))
+	assert.Equal(":5000", printed.Listen)
+	assert.Equal(500*time.Millisecond, printed.StatusInterval.Duration)
+	assert.Equal("********", printed.DB.Password)
+	assert.Equal("secret", c.DB.Password)
+}
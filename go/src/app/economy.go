@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+)
+
+// 部屋の購入状況を checkpoint の時点でまとめたもの。
+// buying を読み直すのは部屋を最初に触ったときだけで、あとは購入のたびに差分で更新する
+type economy struct {
+	items      map[int]mItem
+	checkpoint int64    // この時刻までの生産は milliIsu に足してある
+	milliIsu   *big.Int // 購入で消費した分と checkpoint までに生産した分 (adding は含まない)
+
+	*powerState // checkpoint の時点で建っているもの
+
+	itemBought map[int]int      // ItemID => CountBought
+	itemPrice  map[int]*big.Int // ItemID => 次に買うときの Price
+
+	pending []pendingBuilding // checkpoint より後に建つもの。Time 順
+}
+
+type pendingBuilding struct {
+	Buying
+	power *big.Int
+	sold  bool // true なら Time に取り壊す
+}
+
+// 建っているアイテムによる生産力。
+// boost を持つアイテムが建つと対象のアイテムの Power が増えるので、合計はその都度計算し直す
+type powerState struct {
+	items      map[int]mItem
+	itemBuilt  map[int]int      // ItemID => BuiltCount
+	itemPower  map[int]*big.Int // ItemID => boost をかける前の Power
+	itemBoost  map[int]int64    // ItemID => boost で増える %
+	totalPower *big.Int         // boost をかけた後の Power の合計
+}
+
+func newPowerState(items map[int]mItem) *powerState {
+	ps := &powerState{
+		items:      items,
+		itemBuilt:  map[int]int{},
+		itemPower:  map[int]*big.Int{},
+		itemBoost:  map[int]int64{},
+		totalPower: big.NewInt(0),
+	}
+	for itemID := range items {
+		ps.itemPower[itemID] = big.NewInt(0)
+	}
+	return ps
+}
+
+func (ps *powerState) clone() *powerState {
+	c := &powerState{
+		items:      ps.items,
+		itemBuilt:  map[int]int{},
+		itemPower:  map[int]*big.Int{},
+		itemBoost:  map[int]int64{},
+		totalPower: new(big.Int).Set(ps.totalPower),
+	}
+	for id, n := range ps.itemBuilt {
+		c.itemBuilt[id] = n
+	}
+	for id, p := range ps.itemPower {
+		c.itemPower[id] = new(big.Int).Set(p)
+	}
+	for id, b := range ps.itemBoost {
+		c.itemBoost[id] = b
+	}
+	return c
+}
+
+func (ps *powerState) build(p pendingBuilding) {
+	if _, ok := ps.itemPower[p.ItemID]; !ok {
+		ps.itemPower[p.ItemID] = big.NewInt(0)
+	}
+	m := ps.items[p.ItemID]
+	if p.sold {
+		ps.itemBuilt[p.ItemID]--
+		ps.itemPower[p.ItemID].Sub(ps.itemPower[p.ItemID], p.power)
+		if m.Boost == nil && ps.itemBoost[p.ItemID] == 0 {
+			ps.totalPower.Sub(ps.totalPower, p.power)
+			return
+		}
+	} else {
+		ps.itemBuilt[p.ItemID]++
+		ps.itemPower[p.ItemID].Add(ps.itemPower[p.ItemID], p.power)
+		if m.Boost == nil && ps.itemBoost[p.ItemID] == 0 {
+			ps.totalPower.Add(ps.totalPower, p.power)
+			return
+		}
+	}
+	if m.Boost != nil {
+		percent := m.Boost.Percent
+		if p.sold {
+			percent = -percent
+		}
+		for _, t := range m.Boost.Targets {
+			ps.itemBoost[t] += percent
+		}
+	}
+	// 切り捨てがずれないように、アイテムごとに boost をかけてから足し直す
+	ps.totalPower.SetInt64(0)
+	for id := range ps.itemPower {
+		ps.totalPower.Add(ps.totalPower, ps.itemEffectivePower(id))
+	}
+}
+
+// boost をかけた後の値
+func (ps *powerState) power(itemID int, base *big.Int) *big.Int {
+	boost := ps.itemBoost[itemID]
+	if boost == 0 {
+		return base
+	}
+	v := new(big.Int).Mul(base, big.NewInt(100+boost))
+	return v.Quo(v, big.NewInt(100))
+}
+
+func (ps *powerState) itemEffectivePower(itemID int) *big.Int {
+	return ps.power(itemID, ps.itemPower[itemID])
+}
+
+func newEconomy(items map[int]mItem, buyings []Buying) *economy {
+	e := &economy{
+		items:      items,
+		milliIsu:   big.NewInt(0),
+		powerState: newPowerState(items),
+		itemBought: map[int]int{},
+		itemPrice:  map[int]*big.Int{},
+	}
+	for itemID, m := range items {
+		e.itemPrice[itemID] = m.GetPrice(1)
+	}
+	for _, b := range buyings {
+		e.buy(b)
+	}
+	return e
+}
+
+// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
+func (e *economy) buy(b Buying) {
+	m := e.items[b.ItemID]
+	e.itemBought[b.ItemID]++
+	e.milliIsu.Sub(e.milliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), big.NewInt(1000)))
+	e.itemPrice[b.ItemID] = m.GetPrice(e.itemBought[b.ItemID] + 1)
+
+	e.schedule(pendingBuilding{Buying: b, power: m.GetPower(b.Ordinal)})
+}
+
+// 売ったときはすぐに返金し、sale.Time に取り壊す
+func (e *economy) sell(sale Sale) {
+	m := e.items[sale.ItemID]
+	e.itemBought[sale.ItemID]--
+	e.milliIsu.Add(e.milliIsu, str2big(sale.Refund))
+	e.itemPrice[sale.ItemID] = m.GetPrice(e.itemBought[sale.ItemID] + 1)
+
+	b := Buying{RoomName: sale.RoomName, ItemID: sale.ItemID, Ordinal: sale.Ordinal, Time: sale.Time}
+	e.schedule(pendingBuilding{Buying: b, power: m.GetPower(sale.Ordinal), sold: true})
+}
+
+func (e *economy) schedule(p pendingBuilding) {
+	if p.Time <= e.checkpoint {
+		// checkpoint より前に建っていた (壊れていた) ことになるので、その間の生産の差を足す
+		before := new(big.Int).Set(e.totalPower)
+		e.build(p)
+		gain := new(big.Int).Sub(e.totalPower, before)
+		e.milliIsu.Add(e.milliIsu, gain.Mul(gain, big.NewInt(e.checkpoint-p.Time)))
+		return
+	}
+	i := sort.Search(len(e.pending), func(i int) bool { return e.pending[i].Time > p.Time })
+	e.pending = append(e.pending, pendingBuilding{})
+	copy(e.pending[i+1:], e.pending[i:])
+	e.pending[i] = p
+}
+
+// checkpoint を t まで進める。t は単調に増えていく前提
+func (e *economy) advance(t int64) {
+	if t <= e.checkpoint {
+		return
+	}
+	n := 0
+	for _, p := range e.pending {
+		if p.Time > t {
+			break
+		}
+		e.milliIsu.Add(e.milliIsu, new(big.Int).Mul(e.totalPower, big.NewInt(p.Time-e.checkpoint)))
+		e.checkpoint = p.Time
+		e.build(p)
+		n++
+	}
+	e.pending = e.pending[n:]
+	e.milliIsu.Add(e.milliIsu, new(big.Int).Mul(e.totalPower, big.NewInt(t-e.checkpoint)))
+	e.checkpoint = t
+}
+
+// checkpoint を動かさずに時刻 t (>= checkpoint) での milliIsu を求める
+func (e *economy) milliIsuAt(t int64) *big.Int {
+	milliIsu := new(big.Int).Set(e.milliIsu)
+	checkpoint := e.checkpoint
+	ps := e.powerState
+	for i, p := range e.pending {
+		if p.Time > t {
+			break
+		}
+		if i == 0 {
+			ps = ps.clone()
+		}
+		milliIsu.Add(milliIsu, new(big.Int).Mul(ps.totalPower, big.NewInt(p.Time-checkpoint)))
+		checkpoint = p.Time
+		ps.build(p)
+	}
+	return milliIsu.Add(milliIsu, new(big.Int).Mul(ps.totalPower, big.NewInt(t-checkpoint)))
+}
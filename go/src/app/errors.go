@@ -0,0 +1,48 @@
+package main
+
+// クライアントに返すエラー。
+// Code は機械向けでリトライするかどうかの判断に使い、Message は人が読む用
+type gameError struct {
+	Code    string
+	Message string
+}
+
+func (e *gameError) Error() string {
+	return e.Message
+}
+
+var (
+	// 送った値がおかしい。同じものを送り直しても失敗する
+	errInvalidIsu      = &gameError{"invalid_isu", "isu is not a decimal number"}
+	errNegativeIsu     = &gameError{"negative_isu", "isu must not be negative"}
+	errTooLargeIsu     = &gameError{"too_large_isu", "isu is too large"}
+	errInvalidItem     = &gameError{"invalid_item", "no such item"}
+	errInvalidQuantity = &gameError{"invalid_quantity", "quantity is out of range"}
+
+	// 部屋の状態と合っていない。GameStatus を見直してから送り直す
+	errAlreadyBought = &gameError{"already_bought", "already bought"}
+	errNotBought     = &gameError{"not_bought", "not bought"}
+	errNotLastItem   = &gameError{"not_last_item", "only the last bought item can be sold"}
+	errNotBuilt      = &gameError{"not_built", "item is not built yet"}
+	errNotEnough     = &gameError{"not_enough", "not enough isu"}
+
+	// 時刻がずれている。時刻を合わせてから送り直す
+	errReqTimePast    = &gameError{"req_time_past", "reqTime is past"}
+	errRoomTimeFuture = &gameError{"room_time_future", "room time is future"}
+
+	// 少し待ってから送り直す
+	errRateLimited = &gameError{"rate_limited", "too many isu per second"}
+	errInternal    = &gameError{"internal", "internal server error"}
+
+	// 部屋が別のサーバに移った。reconnect で届くホストにつなぎ直してから送り直す
+	errRoomMoved = &gameError{"room_moved", "room is moved to another server"}
+)
+
+// gameError 以外は中身をクライアントに見せずに internal にする
+func toGameError(err error) *gameError {
+	if e, ok := err.(*gameError); ok {
+		return e
+	}
+	printError(err)
+	return errInternal
+}
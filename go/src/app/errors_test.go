@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGameError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(errNotEnough, toGameError(errNotEnough))
+	assert.Equal(errInternal, toGameError(errors.New("connection refused")))
+
+	r := setupRoom(nil)
+	assert.Equal(errReqTimePast, r.addIsuAt(big.NewInt(1), getCurrentTime()-10000, nil))
+	r.time = getCurrentTime() + 10000
+	assert.Equal(errRoomTimeFuture, r.addIsuAt(big.NewInt(1), getCurrentTime()+20000, nil))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// count 個目のアイテムの Power や Price を決める式。
+// 返した値は memo などと共有していることがあるので書き換えてはいけない
+type formula interface {
+	value(x int) *big.Int
+}
+
+// マスタの power_formula / price_formula。Type によって使うフィールドが変わる
+//
+//	exp:    (cx+1)*d^(ax+b)
+//	linear: base + step*x
+//	tiered: x が Tiers[i].From 以上のところは Tiers[i].Formula を使う
+//	capped: min(Formula, Max)
+type formulaSpec struct {
+	Type string `json:"type"`
+
+	A int64 `json:"a,omitempty"`
+	B int64 `json:"b,omitempty"`
+	C int64 `json:"c,omitempty"`
+	D int64 `json:"d,omitempty"`
+
+	Base int64 `json:"base,omitempty"`
+	Step int64 `json:"step,omitempty"`
+
+	Tiers []formulaTier `json:"tiers,omitempty"`
+
+	Formula *formulaSpec `json:"formula,omitempty"`
+	Max     string       `json:"max,omitempty"`
+}
+
+type formulaTier struct {
+	From    int          `json:"from"`
+	Formula *formulaSpec `json:"formula"`
+}
+
+// 他のアイテムの Power を1個建つごとに Percent % 増やすアイテム
+type boostSpec struct {
+	Targets []int `json:"targets"`
+	Percent int64 `json:"percent"`
+}
+
+type expFormula struct {
+	a, b, c, d int64
+}
+
+func (f expFormula) value(x int) *big.Int {
+	return memo.get(formulaKey{f.a, f.b, f.c, f.d, int64(x)})
+}
+
+type linearFormula struct {
+	base, step int64
+}
+
+func (f linearFormula) value(x int) *big.Int {
+	v := big.NewInt(f.step)
+	v.Mul(v, big.NewInt(int64(x)))
+	return v.Add(v, big.NewInt(f.base))
+}
+
+type tieredFormula struct {
+	from     []int
+	formulas []formula
+}
+
+func (f tieredFormula) value(x int) *big.Int {
+	i := len(f.from) - 1
+	for i > 0 && x < f.from[i] {
+		i--
+	}
+	return f.formulas[i].value(x)
+}
+
+type cappedFormula struct {
+	formula formula
+	max     *big.Int
+}
+
+func (f cappedFormula) value(x int) *big.Int {
+	v := f.formula.value(x)
+	if v.Cmp(f.max) > 0 {
+		return f.max
+	}
+	return v
+}
+
+// validate を通ったものだけ渡すこと
+func (s *formulaSpec) formula() formula {
+	switch s.Type {
+	case "linear":
+		return linearFormula{s.Base, s.Step}
+	case "tiered":
+		f := tieredFormula{}
+		for _, t := range s.Tiers {
+			f.from = append(f.from, t.From)
+			f.formulas = append(f.formulas, t.Formula.formula())
+		}
+		return f
+	case "capped":
+		return cappedFormula{s.Formula.formula(), str2big(s.Max)}
+	}
+	return expFormula{s.A, s.B, s.C, s.D}
+}
+
+// どの x についても負にならないようにする
+func (s *formulaSpec) validate() error {
+	if s == nil {
+		return fmt.Errorf("formula is missing")
+	}
+	switch s.Type {
+	case "exp":
+		return validateExp(s.A, s.B, s.C, s.D)
+	case "linear":
+		if s.Base < 0 || s.Step < 0 {
+			return fmt.Errorf("linear: base and step must not be negative")
+		}
+	case "tiered":
+		if len(s.Tiers) == 0 || s.Tiers[0].From != 0 {
+			return fmt.Errorf("tiered: first tier must start from 0")
+		}
+		for i, t := range s.Tiers {
+			if i > 0 && t.From <= s.Tiers[i-1].From {
+				return fmt.Errorf("tiered: from must be increasing")
+			}
+			if err := t.Formula.validate(); err != nil {
+				return fmt.Errorf("tiered: %v", err)
+			}
+		}
+	case "capped":
+		max, ok := new(big.Int).SetString(s.Max, 10)
+		if !ok || max.Sign() <= 0 {
+			return fmt.Errorf("capped: max must be a positive integer")
+		}
+		if err := s.Formula.validate(); err != nil {
+			return fmt.Errorf("capped: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown formula type: %q", s.Type)
+	}
+	return nil
+}
+
+func validateExp(a, b, c, d int64) error {
+	if a < 0 || b < 0 || c < 0 {
+		return fmt.Errorf("exp: coefficients must not be negative")
+	}
+	if d < 1 {
+		return fmt.Errorf("exp: base must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormulaTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	linear := &formulaSpec{Type: "linear", Base: 10, Step: 3}
+	tiered := &formulaSpec{Type: "tiered", Tiers: []formulaTier{
+		{From: 0, Formula: linear},
+		{From: 5, Formula: &formulaSpec{Type: "exp", B: 3, D: 2}},
+	}}
+	capped := &formulaSpec{Type: "capped", Formula: &formulaSpec{Type: "exp", A: 1, D: 10}, Max: "1000"}
+
+	for _, c := range []struct {
+		spec *formulaSpec
+		x    int
+		want int64
+	}{
+		{linear, 0, 10},
+		{linear, 4, 22},
+		{tiered, 4, 22},
+		{tiered, 5, 8},
+		{capped, 2, 100},
+		{capped, 5, 1000},
+	} {
+		assert.Nil(c.spec.validate())
+		assert.Equal(0, c.spec.formula().value(c.x).Cmp(big.NewInt(c.want)), "%s %d", c.spec.Type, c.x)
+	}
+
+	for _, spec := range []*formulaSpec{
+		{Type: "unknown"},
+		{Type: "linear", Step: -1},
+		{Type: "tiered"},
+		{Type: "tiered", Tiers: []formulaTier{{From: 1, Formula: linear}}},
+		{Type: "tiered", Tiers: []formulaTier{{From: 0, Formula: linear}, {From: 0, Formula: linear}}},
+		{Type: "capped", Formula: linear, Max: "-1"},
+		{Type: "capped", Max: "10"},
+		{Type: "exp", D: 0},
+	} {
+		assert.NotNil(spec.validate(), "%+v", spec)
+	}
+}
+
+func TestBoost(t *testing.T) {
+	assert := assert.New(t)
+
+	mItems := map[int]mItem{
+		1: {ItemID: 1, PowerFormula: &formulaSpec{Type: "linear", Base: 10}, PriceFormula: &formulaSpec{Type: "linear", Base: 1}},
+		2: {ItemID: 2, PowerFormula: &formulaSpec{Type: "linear"}, PriceFormula: &formulaSpec{Type: "linear", Base: 1},
+			Boost: &boostSpec{Targets: []int{1}, Percent: 50}},
+	}
+	buyings := []Buying{
+		{ItemID: 1, Ordinal: 1, Time: 0},
+		{ItemID: 1, Ordinal: 2, Time: 0},
+		{ItemID: 2, Ordinal: 1, Time: 500},
+	}
+	r := setupRoom([]Adding{{Time: 0, Isu: "10"}})
+
+	s, err := calcStatus(r, 0, newEconomy(mItems, buyings))
+	assert.Nil(err)
+	sortItems(s.Items)
+
+	// 500 ミリ秒で item 2 が建って item 1 の Power が 20 から 30 になる
+	assert.Equal(big2exp(big.NewInt(20)), s.Items[0].Power)
+	assert.Equal(1, len(s.Items[0].Building))
+	assert.Equal(big2exp(big.NewInt(30)), s.Items[0].Building[0].Power)
+	last := s.Schedule[len(s.Schedule)-1]
+	assert.Equal(int64(500), last.Time)
+	assert.Equal(big2exp(big.NewInt(30)), last.TotalPower)
+
+	// checkpoint を進めた後も同じになる
+	e := newEconomy(mItems, buyings)
+	e.advance(1000)
+	assert.Equal(0, e.totalPower.Cmp(big.NewInt(30)))
+	assert.Equal(0, e.milliIsu.Cmp(big.NewInt(-3000+20*500+30*500)), e.milliIsu.String())
+}
+
+func TestLoadItemsFormula(t *testing.T) {
+	assert := assert.New(t)
+
+	path := writeItemsFile(t, `[
+		{"item_id": 1, "power_formula": {"type": "linear", "base": 1, "step": 1},
+		 "price_formula": {"type": "capped", "max": "5", "formula": {"type": "exp", "a": 1, "d": 2}}},
+		{"item_id": 2, "power4": 1, "price4": 1, "boost": {"targets": [1], "percent": 10}}
+	]`)
+	defer os.Remove(path)
+	m, err := loadItems(path)
+	assert.Nil(err)
+	item := m[1]
+	assert.Equal(0, item.GetPower(3).Cmp(big.NewInt(4)))
+	assert.Equal(0, item.GetPrice(2).Cmp(big.NewInt(4)))
+	assert.Equal(0, item.GetPrice(3).Cmp(big.NewInt(5)))
+
+	path2 := writeItemsFile(t, `[{"item_id": 1, "power4": 1, "price4": 1, "boost": {"targets": [2], "percent": 10}}]`)
+	defer os.Remove(path2)
+	_, err = loadItems(path2)
+	assert.NotNil(err)
+}
@@ -2,233 +2,275 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"fmt"
-	"log"
 	"math/big"
-	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/websocket"
-	"github.com/jmoiron/sqlx"
 )
 
+// 部屋の一覧。ロックは rooms の出し入れにだけ使い、部屋の中身は各部屋の goroutine が持つ
 type AddingCache struct {
-	que   map[string]map[int64]*big.Int
-	total map[string]*big.Int
-	mux   *sync.Mutex
-}
-type DumpCache struct {
-	que   map[string]map[int64]string
-	total map[string]string
+	rooms map[string]*room
+	mux   *sync.RWMutex
+	store Storage
+	log   *addingLog
+
+	stop    chan struct{} // 閉じたら定期の DumpFile をやめる
+	stopped chan struct{}
 }
 
+// スナップショットを書く間隔
+var snapshotInterval = 10 * time.Second
+
 var (
-	ac = newAddingCache()
+	ac *AddingCache
 )
 
-func newAddingCache() *AddingCache {
+// l が nil のときはログを取らず、スナップショットも書かない
+func newAddingCache(store Storage, l *addingLog) (*AddingCache, error) {
 	d := &AddingCache{
-		make(map[string]map[int64]*big.Int),
-		make(map[string]*big.Int),
-		&sync.Mutex{},
+		make(map[string]*room),
+		&sync.RWMutex{},
+		store,
+		l,
+		make(chan struct{}),
+		make(chan struct{}),
+	}
+	if err := d.Replay(); err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return d, nil
 	}
-	d.ParseFile()
 	go func() {
-		t := time.NewTicker(1 * time.Second)
+		defer close(d.stopped)
+		t := time.NewTicker(snapshotInterval)
+		defer t.Stop()
 		for {
 			select {
 			case <-t.C:
 				d.DumpFile()
+			case <-d.stop:
+				return
 			}
 		}
 	}()
-	return d
+	return d, nil
 }
 
-func (c *AddingCache) Clean() {
-	c.que = make(map[string]map[int64]*big.Int)
-	c.total = make(map[string]*big.Int)
-}
-
-func (c *AddingCache) ParseFile() {
-	c.Clean()
-	queFile, err := os.Open("/home/isucon/que.csv")
-	defer queFile.Close()
-	if err == nil {
-		r := csv.NewReader(queFile)
-		records, err := r.ReadAll()
-		if err == nil {
-			for _, r := range records {
-				name := r[0]
-				time, _ := strconv.ParseInt(r[1], 10, 64)
-				val := str2big(r[2])
-				if _, ok := c.que[name]; !ok {
-					c.que[name] = make(map[int64]*big.Int)
-				}
-				c.que[name][time] = val
-			}
-		}
+// 定期の DumpFile を止めてから最後に1回書く。書いている途中のものがあれば終わるのを待つ
+func (c *AddingCache) Close() error {
+	if c.log == nil {
+		return nil
 	}
-
-	totalFile, err := os.Open("/home/isucon/total.csv")
-	defer totalFile.Close()
-	if err == nil {
-		r := csv.NewReader(totalFile)
-		records, err := r.ReadAll()
-		if err == nil {
-			for _, r := range records {
-				name := r[0]
-				val := str2big(r[1])
-				c.total[name] = val
-			}
-		}
+	close(c.stop)
+	<-c.stopped
+	if err := c.DumpFile(); err != nil {
+		return err
 	}
+	return c.log.Sync()
 }
 
-func (c *AddingCache) DumpFile() {
-	queFile, err := os.Create("/home/isucon/que.csv")
-	defer queFile.Close()
-	if err != nil {
-		log.Println("failed to dump")
-		return
-	}
-	totalFile, err := os.Create("/home/isucon/total.csv")
-	defer totalFile.Close()
-	if err != nil {
-		log.Println("failed to dump")
-		return
+func (c *AddingCache) room(roomName string) *room {
+	c.mux.RLock()
+	r, ok := c.rooms[roomName]
+	c.mux.RUnlock()
+	if ok {
+		return r
 	}
 
-	queWriter := csv.NewWriter(queFile)
-	for name, v := range c.que {
-		for time, val := range v {
-			err := queWriter.Write([]string{name, strconv.FormatInt(time, 10), val.String()})
-			if err != nil {
-				log.Println("Error: " + err.Error())
-			}
-		}
-	}
-	queWriter.Flush()
-	if err := queWriter.Error(); err != nil {
-		log.Println("Error: " + err.Error())
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if r, ok := c.rooms[roomName]; ok {
+		return r
 	}
+	s := newRoomState(roomName, c.log)
+	// 移した部屋は片付けられた後も移し先を返す
+	s.movedTo = movedHost(roomName)
+	r = startRoom(c, s)
+	c.rooms[roomName] = r
+	return r
+}
 
-	totalWriter := csv.NewWriter(totalFile)
-	for name, val := range c.total {
-		err := totalWriter.Write([]string{name, val.String()})
-		if err != nil {
-			log.Println("Error: " + err.Error())
-		}
-	}
-	totalWriter.Flush()
-	if err := totalWriter.Error(); err != nil {
-		log.Println("Error: " + err.Error())
+// 片付けられていない部屋だけで fn を実行する
+func (c *AddingCache) eachRoom(fn func(s *roomState)) {
+	for _, r := range c.allRooms() {
+		r.tryDo(fn)
 	}
 }
 
-func (c *AddingCache) addIsu(roomName string, reqIsu big.Int, reqTime int64) bool {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	if _, ok := c.que[roomName]; !ok {
-		c.que[roomName] = make(map[int64]*big.Int)
+func (c *AddingCache) allRooms() []*room {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	rooms := make([]*room, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		rooms = append(rooms, r)
 	}
-	if _, ok := c.que[roomName][reqTime]; !ok {
-		c.que[roomName][reqTime] = big.NewInt(0)
+	return rooms
+}
+
+// clean を先にログに書いてから各部屋を空にする
+func (c *AddingCache) Clean() {
+	if err := c.log.Append(logRecord{Op: logOpClean}); err != nil {
+		logs.error("failed to append log", "err", err)
 	}
-	c.que[roomName][reqTime].Add(c.que[roomName][reqTime], &reqIsu)
-	return true
+	placements.clear()
+	c.eachRoom(func(s *roomState) {
+		s.reset()
+		s.movedTo = ""
+	})
 }
 
-func (c *AddingCache) getTotal(roomName string, reqTime int64) big.Int {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	if _, ok := c.total[roomName]; !ok {
-		c.total[roomName] = big.NewInt(0)
-	}
-	if _, ok := c.que[roomName]; !ok {
-		c.que[roomName] = make(map[int64]*big.Int)
-	}
-	vs := make([]int64, 0, 0)
-	rest := new(big.Int)
-	for k, v := range c.que[roomName] {
-		if k <= reqTime-1000 {
-			c.total[roomName].Add(c.total[roomName], big.NewInt(0).Mul(v, big.NewInt(1000)))
-			vs = append(vs, k)
-		} else if k <= reqTime {
-			rest.Add(rest, big.NewInt(0).Mul(v, big.NewInt(1000)))
+// 片付けられていない部屋の数
+func (c *AddingCache) roomCount() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return len(c.rooms)
+}
+
+// スナップショットを読んだあとに、それ以降のログを再生する
+func (c *AddingCache) Replay() error {
+	snap, err := c.store.LoadAddings()
+	if err != nil {
+		return err
+	}
+
+	placements.clear()
+	states := map[string]*roomState{}
+	get := func(roomName string) *roomState {
+		if _, ok := states[roomName]; !ok {
+			states[roomName] = newRoomState(roomName, c.log)
 		}
+		return states[roomName]
 	}
-	for _, k := range vs {
-		delete(c.que[roomName], k)
+	for name, que := range snap.que {
+		get(name).que = que
 	}
-	rest.Add(rest, c.total[roomName])
-	return *rest
-}
-func (c *AddingCache) setAddingAt(roomName string, currentTime int64, addingAt map[int64]Adding) {
+	for name, total := range snap.total {
+		get(name).total = total
+	}
+	err = c.log.Replay(func(rec logRecord) {
+		if rec.Op == logOpClean {
+			states = map[string]*roomState{}
+			placements.clear()
+			return
+		}
+		if rec.Op == logOpMoved || rec.Op == logOpImported {
+			placements.apply(rec)
+			return
+		}
+		if rec.Op == logOpDrop {
+			delete(states, rec.Room)
+			return
+		}
+		get(rec.Room).apply(rec)
+	})
+	if err != nil {
+		return err
+	}
+
 	c.mux.Lock()
 	defer c.mux.Unlock()
-	for k, v := range c.que[roomName] {
-		if k <= currentTime {
-			// 存在しないはず
-		} else {
-			addingAt[k] = Adding{roomName, k, v.String(), v}
+	for name, s := range states {
+		s.movedTo = movedHost(name)
+		c.rooms[name] = startRoom(c, s)
+	}
+	return nil
+}
+
+// ログを切り替えてから各部屋の状態を集めてスナップショットとして書き出し、古いログを捨てる。
+// ログは適用後の値を持っているので、部屋ごとに集める時刻がずれていても再生すれば同じ状態になる
+func (c *AddingCache) DumpFile() error {
+	start := time.Now()
+	defer metricDump.since(start)
+	if err := c.log.Rotate(); err != nil {
+		logs.error("failed to rotate log", "err", err)
+		metricDumpErrors.inc()
+		return err
+	}
+	// 前のログは後で消すので、移した部屋と移してきた部屋は新しいログに書き直す
+	if err := placements.appendTo(c.log); err != nil {
+		logs.error("failed to append log", "err", err)
+		metricDumpErrors.inc()
+		return err
+	}
+
+	snap := newAddingSnapshot()
+	c.eachRoom(func(s *roomState) {
+		for t, v := range s.que {
+			snap.setQue(s.name, t, new(big.Int).Set(v))
 		}
+		snap.total[s.name] = new(big.Int).Set(s.total)
+	})
+
+	if err := c.store.SaveAddings(snap); err != nil {
+		logs.error("failed to dump", "err", err)
+		metricDumpErrors.inc()
+		health.setDumped(err)
+		return err
+	}
+	health.setDumped(nil)
+	// .prev が残っていても次の起動で再生されるだけなので失敗にはしない
+	if err := c.log.Compact(); err != nil {
+		logs.error("failed to compact log", "err", err)
 	}
+	return nil
 }
 
-var (
-	roomTime = map[string]int64{}
-	timeMux  = &sync.Mutex{}
-)
-
 func getCurrentTime() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
 func printError(err error) {
-	log.Println("Error:" + err.Error())
-}
-
-func updateRoomTime(tx *sqlx.Tx, roomName string, reqTime int64) (int64, bool) {
-	timeMux.Lock()
-	defer timeMux.Unlock()
-	currentTime := getCurrentTime()
-	if rt, ok := roomTime[roomName]; ok {
-		if currentTime < rt {
-			log.Println("room time is future")
-			return 0, false
-		}
-	}
-	if reqTime != 0 {
-		if reqTime < currentTime {
-			log.Println("reqTime is past")
-			return 0, false
-		}
-	}
-	roomTime[roomName] = currentTime
-	return currentTime, true
+	logs.error("error", "err", err)
 }
 
 type GameRequest struct {
 	RequestID int    `json:"request_id"`
+	ClientID  string `json:"client_id"` // あれば送り直しを見分けるのに使う
 	Action    string `json:"action"`
 	Time      int64  `json:"time"`
 
 	// for addIsu
 	Isu string `json:"isu"`
 
-	// for buyItem
-	ItemID      int `json:"item_id"`
-	CountBought int `json:"count_bought"`
+	// for buyItem, sellItem
+	ItemID      int  `json:"item_id"`
+	CountBought int  `json:"count_bought"`
+	Quantity    int  `json:"quantity"` // 0 なら 1 個
+	BuyMax      bool `json:"buy_max"`  // 買えるだけ買う。Quantity は上限になる
+}
+
+// 1回の buyItem で買える数の上限
+const maxBuyQuantity = 1000
+
+// sellItem で返ってくるのは買ったときの Price の何 % か。ISU_SELL_REFUND_PERCENT で変えられる
+var sellRefundPercent int64 = 50
+
+func (req *GameRequest) buyQuantity() int {
+	q := req.Quantity
+	if q == 0 {
+		q = 1
+		if req.BuyMax {
+			q = maxBuyQuantity
+		}
+	}
+	return q
 }
 
 type GameResponse struct {
 	RequestID int  `json:"request_id"`
 	IsSuccess bool `json:"is_success"`
+	// 失敗したときだけ入る。ErrorCode は errors.go の gameError.Code
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// ISU_TRACE があるときだけ入る。span の trace_id と同じ
+	TraceID string `json:"trace_id,omitempty"`
 }
 
 // 10進数の指数表記に使うデータ。JSONでは [仮数部, 指数部] という2要素配列になる。
@@ -246,7 +288,7 @@ type Adding struct {
 	RoomName string   `json:"-" db:"room_name"`
 	Time     int64    `json:"time" db:"time"`
 	Isu      string   `json:"isu" db:"isu"`
-	IsuVal   *big.Int `json:"-" db"-"`
+	IsuVal   *big.Int `json:"-" db:"-"`
 }
 
 type Buying struct {
@@ -256,6 +298,20 @@ type Buying struct {
 	Time     int64  `db:"time"`
 }
 
+// 売ったアイテム。buying からは消えるが、売るまでの生産と返金の分を計算するのに残しておく
+type Sale struct {
+	RoomName   string `db:"room_name"`
+	ItemID     int    `db:"item_id"`
+	Ordinal    int    `db:"ordinal"`
+	BoughtTime int64  `db:"bought_time"`
+	Time       int64  `db:"time"`
+	Refund     string `db:"refund"` // ミリ椅子
+}
+
+func (s Sale) buying() Buying {
+	return Buying{RoomName: s.RoomName, ItemID: s.ItemID, Ordinal: s.Ordinal, Time: s.BoughtTime}
+}
+
 type Schedule struct {
 	Time       int64       `json:"time"`
 	MilliIsu   Exponential `json:"milli_isu"`
@@ -291,57 +347,64 @@ type GameStatus struct {
 }
 
 type mItem struct {
-	ItemID int   `db:"item_id"`
-	Power1 int64 `db:"power1"`
-	Power2 int64 `db:"power2"`
-	Power3 int64 `db:"power3"`
-	Power4 int64 `db:"power4"`
-	Price1 int64 `db:"price1"`
-	Price2 int64 `db:"price2"`
-	Price3 int64 `db:"price3"`
-	Price4 int64 `db:"price4"`
-}
-
-var mItems = map[int]mItem{
-	1:  {ItemID: 1, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1},
-	2:  {ItemID: 2, Power1: 0, Power2: 1, Power3: 1, Power4: 1, Price1: 0, Price2: 1, Price3: 2, Price4: 1},
-	3:  {ItemID: 3, Power1: 1, Power2: 10, Power3: 0, Power4: 2, Price1: 1, Price2: 3, Price3: 1, Price4: 2},
-	4:  {ItemID: 4, Power1: 1, Power2: 24, Power3: 1, Power4: 2, Price1: 1, Price2: 10, Price3: 0, Price4: 3},
-	5:  {ItemID: 5, Power1: 1, Power2: 25, Power3: 100, Power4: 3, Price1: 2, Price2: 20, Price3: 20, Price4: 2},
-	6:  {ItemID: 6, Power1: 1, Power2: 30, Power3: 147, Power4: 13, Price1: 1, Price2: 22, Price3: 69, Price4: 17},
-	7:  {ItemID: 7, Power1: 5, Power2: 80, Power3: 128, Power4: 6, Price1: 6, Price2: 61, Price3: 200, Price4: 5},
-	8:  {ItemID: 8, Power1: 20, Power2: 340, Power3: 180, Power4: 3, Price1: 9, Price2: 105, Price3: 134, Price4: 14},
-	9:  {ItemID: 9, Power1: 55, Power2: 520, Power3: 335, Power4: 5, Price1: 48, Price2: 243, Price3: 600, Price4: 7},
-	10: {ItemID: 10, Power1: 157, Power2: 1071, Power3: 1700, Power4: 12, Price1: 157, Price2: 625, Price3: 1000, Price4: 13},
-	11: {ItemID: 11, Power1: 2000, Power2: 7500, Power3: 2600, Power4: 3, Price1: 2001, Price2: 5430, Price3: 1000, Price4: 3},
-	12: {ItemID: 12, Power1: 1000, Power2: 9000, Power3: 0, Power4: 17, Price1: 963, Price2: 7689, Price3: 1, Price4: 19},
-	13: {ItemID: 13, Power1: 11000, Power2: 11000, Power3: 11000, Power4: 23, Price1: 10000, Price2: 2, Price3: 2, Price4: 29},
+	ItemID int    `json:"item_id" db:"item_id"`
+	Name   string `json:"name" db:"name"`
+	Power1 int64  `json:"power1" db:"power1"`
+	Power2 int64  `json:"power2" db:"power2"`
+	Power3 int64  `json:"power3" db:"power3"`
+	Power4 int64  `json:"power4" db:"power4"`
+	Price1 int64  `json:"price1" db:"price1"`
+	Price2 int64  `json:"price2" db:"price2"`
+	Price3 int64  `json:"price3" db:"price3"`
+	Price4 int64  `json:"price4" db:"price4"`
+
+	// 指定があれば Power1-4, Price1-4 の代わりに使う
+	PowerFormula *formulaSpec `json:"power_formula,omitempty" db:"-"`
+	PriceFormula *formulaSpec `json:"price_formula,omitempty" db:"-"`
+	Boost        *boostSpec   `json:"boost,omitempty" db:"-"`
+}
+
+// ISU_ITEMS を指定しないときに使うマスタ
+var defaultItems = map[int]mItem{
+	1:  {ItemID: 1, Name: "おじいちゃん", Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1},
+	2:  {ItemID: 2, Name: "椅子畑", Power1: 0, Power2: 1, Power3: 1, Power4: 1, Price1: 0, Price2: 1, Price3: 2, Price4: 1},
+	3:  {ItemID: 3, Name: "椅子採掘場", Power1: 1, Power2: 10, Power3: 0, Power4: 2, Price1: 1, Price2: 3, Price3: 1, Price4: 2},
+	4:  {ItemID: 4, Name: "椅子工場", Power1: 1, Power2: 24, Power3: 1, Power4: 2, Price1: 1, Price2: 10, Price3: 0, Price4: 3},
+	5:  {ItemID: 5, Name: "禁断の秘術†椅子†", Power1: 1, Power2: 25, Power3: 100, Power4: 3, Price1: 2, Price2: 20, Price3: 20, Price4: 2},
+	6:  {ItemID: 6, Name: "確定拠出椅子", Power1: 1, Power2: 30, Power3: 147, Power4: 13, Price1: 1, Price2: 22, Price3: 69, Price4: 17},
+	7:  {ItemID: 7, Name: "クローン椅子技術", Power1: 5, Power2: 80, Power3: 128, Power4: 6, Price1: 6, Price2: 61, Price3: 200, Price4: 5},
+	8:  {ItemID: 8, Name: "椅子錬成陣", Power1: 20, Power2: 340, Power3: 180, Power4: 3, Price1: 9, Price2: 105, Price3: 134, Price4: 14},
+	9:  {ItemID: 9, Name: "太陽光発椅子", Power1: 55, Power2: 520, Power3: 335, Power4: 5, Price1: 48, Price2: 243, Price3: 600, Price4: 7},
+	10: {ItemID: 10, Name: "加圧水型椅子炉", Power1: 157, Power2: 1071, Power3: 1700, Power4: 12, Price1: 157, Price2: 625, Price3: 1000, Price4: 13},
+	11: {ItemID: 11, Name: "椅子テラフォーミング", Power1: 2000, Power2: 7500, Power3: 2600, Power4: 3, Price1: 2001, Price2: 5430, Price3: 1000, Price4: 3},
+	12: {ItemID: 12, Name: "椅子界への門", Power1: 1000, Power2: 9000, Power3: 0, Power4: 17, Price1: 963, Price2: 7689, Price3: 1, Price4: 19},
+	13: {ItemID: 13, Name: "椅子神託", Power1: 11000, Power2: 11000, Power3: 11000, Power4: 23, Price1: 10000, Price2: 2, Price3: 2, Price4: 29},
+}
+
+func (item *mItem) powerFormula() formula {
+	if item.PowerFormula != nil {
+		return item.PowerFormula.formula()
+	}
+	// power(x):=(cx+1)*d^(ax+b)
+	return expFormula{item.Power1, item.Power2, item.Power3, item.Power4}
 }
 
-func (item *mItem) GetPower(count int) *big.Int {
-	// power(x):=(cx+1)*d^(ax+b)
-	a := item.Power1
-	b := item.Power2
-	c := item.Power3
-	d := item.Power4
-	x := int64(count)
+func (item *mItem) priceFormula() formula {
+	if item.PriceFormula != nil {
+		return item.PriceFormula.formula()
+	}
+	// price(x):=(cx+1)*d^(ax+b)
+	return expFormula{item.Price1, item.Price2, item.Price3, item.Price4}
+}
 
-	s := big.NewInt(c*x + 1)
-	t := new(big.Int).Exp(big.NewInt(d), big.NewInt(a*x+b), nil)
-	return new(big.Int).Mul(s, t)
+// 返した値は memo と共有していることがあるので書き換えてはいけない
+func (item *mItem) GetPower(count int) *big.Int {
+	return item.powerFormula().value(count)
 }
 
+// 返した値は memo と共有していることがあるので書き換えてはいけない
 func (item *mItem) GetPrice(count int) *big.Int {
-	// price(x):=(cx+1)*d^(ax+b)
-	a := item.Price1
-	b := item.Price2
-	c := item.Price3
-	d := item.Price4
-	x := int64(count)
-
-	s := big.NewInt(c*x + 1)
-	t := new(big.Int).Exp(big.NewInt(d), big.NewInt(a*x+b), nil)
-	return new(big.Int).Mul(s, t)
+	return item.priceFormula().value(count)
 }
 
 func str2big(s string) *big.Int {
@@ -359,116 +422,230 @@ func big2exp(n *big.Int) Exponential {
 
 	t, err := strconv.ParseInt(s[:15], 10, 64)
 	if err != nil {
-		log.Panic(err)
+		panic(err)
 	}
 	return Exponential{t, int64(len(s) - 15)}
 }
 
-func addIsu(roomName string, reqIsu *big.Int, reqTime int64) bool {
-	_, ok := updateRoomTime(nil, roomName, reqTime)
-	if !ok {
-		log.Println("Warn: updateRoomTime failed")
-		return false
+// 部屋の goroutine で fn を実行し、成功したら他の購読者に GameStatus を配る。
+// key.clientID があれば、一度成功したものは実行し直さずに replayed を返す。
+// 部屋の中での処理は sp の下に span を作り、lg があれば s.lg の代わりに使う
+func runTracedAction(roomName string, sub *subscriber, key requestKey, sp *span, lg *logger, fn func(s *roomState) error) (status *GameStatus, replayed bool, err error) {
+	rsp := sp.child("room")
+	defer func() {
+		rsp.fail(err)
+		rsp.end()
+	}()
+	ac.room(roomName).do(func(s *roomState) {
+		s.span = rsp
+		roomLog := s.lg
+		if lg != nil {
+			s.lg = lg
+		}
+		defer func() {
+			s.span = nil
+			s.lg = roomLog
+		}()
+		s.active = time.Now()
+		if s.movedTo != "" {
+			err = errRoomMoved
+			return
+		}
+		if key.clientID != "" && s.requests.has(key) {
+			replayed = true
+			return
+		}
+		err = fn(s)
+		if err != nil {
+			return
+		}
+		if key.clientID != "" {
+			s.requests.add(key)
+		}
+		status = s.publish(sub)
+	})
+	return status, replayed, err
+}
+
+// conn は接続ごとの制限 (なければ nil)。
+// 時刻が合っているものだけ数え、部屋の制限や書き込みで失敗したら使った分を戻す
+func (s *roomState) addIsuAt(reqIsu *big.Int, reqTime int64, conn *isuLimiter) error {
+	if _, err := s.updateTime(reqTime); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !conn.allow(reqIsu, now) {
+		s.lg.warn("addIsu is rate limited", "isu", reqIsu, "limit", "connection")
+		return errRateLimited
+	}
+	if !s.limiter.allow(reqIsu, now) {
+		conn.refund(reqIsu)
+		s.lg.warn("addIsu is rate limited", "isu", reqIsu, "limit", "room")
+		return errRateLimited
 	}
 
-	return ac.addIsu(roomName, *reqIsu, reqTime)
+	if !s.addIsu(reqIsu, reqTime) {
+		conn.refund(reqIsu)
+		s.limiter.refund(reqIsu)
+		return errInternal
+	}
+	return nil
 }
 
-func buyItem(roomName string, itemID int, countBought int, reqTime int64) bool {
-	tx, err := db.Beginx()
-	if err != nil {
-		printError(err)
-		return false
+// countBought+1 個目から quantity 個をまとめて買う。
+// buyMax なら買えるところまで (1個以上) 買い、そうでなければ全部買えるときだけ買う
+func (s *roomState) buyItem(itemID int, countBought int, quantity int, buyMax bool, reqTime int64) (err error) {
+	sp := s.startSpan("buyItem")
+	sp.set("item_id", itemID)
+	sp.set("count_bought", countBought)
+	sp.set("quantity", quantity)
+	defer func() { s.endSpan(sp, err) }()
+
+	if quantity < 1 || maxBuyQuantity < quantity {
+		s.lg.warn("invalid quantity", "quantity", quantity)
+		return errInvalidQuantity
 	}
 
-	_, ok := updateRoomTime(tx, roomName, reqTime)
-	if !ok {
-		log.Println("Warn: updateRoomTime failed")
-		return false
+	if _, err := s.updateTime(reqTime); err != nil {
+		return err
 	}
 
-	var countBuying int
-	err = tx.Get(&countBuying, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ?", roomName, itemID)
+	e, err := s.loadEconomy()
 	if err != nil {
-		printError(err)
-		tx.Rollback()
-		return false
+		return toGameError(err)
+	}
+
+	item, ok := e.items[itemID]
+	if !ok {
+		s.lg.warn("invalid item", "item_id", itemID)
+		return errInvalidItem
 	}
-	if countBuying != countBought {
-		tx.Rollback()
-		log.Println(roomName, itemID, countBought+1, " is already bought")
-		return false
+	if e.itemBought[itemID] != countBought {
+		s.lg.info("already bought", "item_id", itemID, "ordinal", countBought+1)
+		return errAlreadyBought
 	}
 
-	totalMilliIsu_ := ac.getTotal(roomName, reqTime)
-	totalMilliIsu := new(big.Int)
-	totalMilliIsu.Add(totalMilliIsu, &totalMilliIsu_) // TODO: oh
+	totalMilliIsu := s.getTotal(reqTime)
+	totalMilliIsu.Add(totalMilliIsu, e.milliIsuAt(reqTime))
 
-	var buyings []Buying
-	err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
-	if err != nil {
-		printError(err)
-		tx.Rollback()
-		return false
-	}
-	for _, b := range buyings {
-		item := mItems[b.ItemID]
-		cost := new(big.Int).Mul(item.GetPrice(b.Ordinal), big.NewInt(1000))
-		totalMilliIsu.Sub(totalMilliIsu, cost)
-		if b.Time <= reqTime {
-			gain := new(big.Int).Mul(item.GetPower(b.Ordinal), big.NewInt(reqTime-b.Time))
-			totalMilliIsu.Add(totalMilliIsu, gain)
+	bs := []Buying{}
+	for len(bs) < quantity {
+		ordinal := countBought + len(bs) + 1
+		need := new(big.Int).Mul(item.GetPrice(ordinal), big.NewInt(1000))
+		if totalMilliIsu.Cmp(need) < 0 {
+			break
 		}
+		totalMilliIsu.Sub(totalMilliIsu, need)
+		bs = append(bs, Buying{RoomName: s.name, ItemID: itemID, Ordinal: ordinal, Time: reqTime})
 	}
-
-	item := mItems[itemID]
-	need := new(big.Int).Mul(item.GetPrice(countBought+1), big.NewInt(1000))
-	if totalMilliIsu.Cmp(need) < 0 {
-		log.Println("not enough")
-		tx.Rollback()
-		return false
+	if len(bs) == 0 || (!buyMax && len(bs) < quantity) {
+		s.lg.info("not enough isu", "item_id", itemID, "ordinal", countBought+1, "quantity", quantity)
+		return errNotEnough
 	}
 
-	_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, itemID, countBought+1, reqTime)
+	asp := s.startSpan("store.AddBuyings")
+	err = store.AddBuyings(bs)
+	s.endSpan(asp, err)
+	if err == errAlreadyBought {
+		s.lg.info("already bought", "item_id", itemID, "ordinal", countBought+1)
+		return err
+	}
 	if err != nil {
-		printError(err)
-		tx.Rollback()
-		return false
+		return toGameError(err)
 	}
-
-	if err := tx.Commit(); err != nil {
-		printError(err)
-		return false
+	for _, b := range bs {
+		e.buy(b)
 	}
 
-	return true
+	return nil
 }
 
-func getStatus(roomName string) (*GameStatus, error) {
-	tx, err := db.Beginx()
+// 最後に買った countBought 個目を reqTime に売る。まだ建っていないものは売れない
+func (s *roomState) sellItem(itemID int, countBought int, reqTime int64) error {
+	currentTime, err := s.updateTime(reqTime)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	currentTime, ok := updateRoomTime(tx, roomName, 0)
+	e, err := s.loadEconomy()
+	if err != nil {
+		return toGameError(err)
+	}
+
+	item, ok := e.items[itemID]
 	if !ok {
-		tx.Rollback()
-		return nil, fmt.Errorf("updateRoomTime failure")
+		s.lg.warn("invalid item", "item_id", itemID)
+		return errInvalidItem
+	}
+	if countBought < 1 || e.itemBought[itemID] != countBought {
+		s.lg.info("not the last item", "item_id", itemID, "ordinal", countBought)
+		return errNotLastItem
+	}
+
+	buyings, err := store.Buyings(s.name)
+	if err != nil {
+		return toGameError(err)
+	}
+	var bought *Buying
+	for i, b := range buyings {
+		if b.ItemID == itemID && b.Ordinal == countBought {
+			bought = &buyings[i]
+		}
 	}
+	if bought == nil {
+		s.lg.info("not bought", "item_id", itemID, "ordinal", countBought)
+		return errNotBought
+	}
+	if bought.Time > currentTime {
+		s.lg.info("not built yet", "item_id", itemID, "ordinal", countBought)
+		return errNotBuilt
+	}
+
+	refund := new(big.Int).Mul(item.GetPrice(countBought), big.NewInt(1000))
+	refund.Mul(refund, big.NewInt(sellRefundPercent))
+	refund.Quo(refund, big.NewInt(100))
 
-	buyings := []Buying{}
-	err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
+	sale := Sale{
+		RoomName:   s.name,
+		ItemID:     itemID,
+		Ordinal:    countBought,
+		BoughtTime: bought.Time,
+		Time:       reqTime,
+		Refund:     refund.String(),
+	}
+	err = store.SellBuying(sale)
+	if err == errNotBought {
+		s.lg.info("not bought", "item_id", itemID, "ordinal", countBought)
+		return err
+	}
+	if err != nil {
+		return toGameError(err)
+	}
+	e.sell(sale)
+
+	return nil
+}
+
+func (s *roomState) getStatus() (status *GameStatus, err error) {
+	sp := s.startSpan("getStatus")
+	defer func() { s.endSpan(sp, err) }()
+
+	currentTime, err := s.updateTime(0)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
 
-	err = tx.Commit()
+	e, err := s.loadEconomy()
 	if err != nil {
 		return nil, err
 	}
 
-	status, err := calcStatus(roomName, currentTime, mItems, buyings)
+	start := time.Now()
+	csp := s.startSpan("calcStatus")
+	status, err = calcStatus(s, currentTime, e)
+	s.endSpan(csp, err)
+	metricCalcStatus.since(start)
 	if err != nil {
 		return nil, err
 	}
@@ -480,57 +657,46 @@ func getStatus(roomName string) (*GameStatus, error) {
 	return status, err
 }
 
-func calcStatus(roomName string, currentTime int64, mItems map[int]mItem, buyings []Buying) (*GameStatus, error) {
+func calcStatus(s *roomState, currentTime int64, e *economy) (*GameStatus, error) {
+	e.advance(currentTime)
+
 	var (
+		mItems = e.items
+
 		// 1ミリ秒に生産できる椅子の単位をミリ椅子とする
-		totalMilliIsu_ = ac.getTotal(roomName, currentTime)
-		totalPower     = big.NewInt(0)
+		totalMilliIsu = s.getTotal(currentTime)
+		ps            = e.powerState.clone() // simulationWindow 先まで建てていく
+		totalPower    = ps.totalPower        // ps.build で更新される
 
-		itemPower    = map[int]*big.Int{}    // ItemID => Power
-		itemPrice    = map[int]*big.Int{}    // ItemID => Price
+		itemPrice    = e.itemPrice           // ItemID => Price
 		itemOnSale   = map[int]int64{}       // ItemID => OnSale
-		itemBuilt    = map[int]int{}         // ItemID => BuiltCount
-		itemBought   = map[int]int{}         // ItemID => CountBought
+		itemBought   = e.itemBought          // ItemID => CountBought
 		itemBuilding = map[int][]Building{}  // ItemID => Buildings
 		itemPower0   = map[int]Exponential{} // ItemID => currentTime における Power
-		itemBuilt0   = map[int]int{}         // ItemID => currentTime における BuiltCount
+		itemBuilt0   = e.itemBuilt           // ItemID => currentTime における BuiltCount
 
-		addingAt = map[int64]Adding{}   // Time => currentTime より先の Adding
-		buyingAt = map[int64][]Buying{} // Time => currentTime より先の Buying
+		addingAt = map[int64]Adding{}            // Time => currentTime より先の Adding
+		buyingAt = map[int64][]pendingBuilding{} // Time => currentTime より先の Buying
 	)
-	totalMilliIsu := new(big.Int)
-	totalMilliIsu.Add(totalMilliIsu, &totalMilliIsu_) // TODO: oh
+	totalMilliIsu.Add(totalMilliIsu, e.milliIsu)
 
 	for itemID := range mItems {
-		itemPower[itemID] = big.NewInt(0)
 		itemBuilding[itemID] = []Building{}
 	}
 
-	ac.setAddingAt(roomName, currentTime, addingAt)
-
-	for _, b := range buyings {
-		// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
-		itemBought[b.ItemID]++
-		m := mItems[b.ItemID]
-		totalMilliIsu.Sub(totalMilliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), big.NewInt(1000)))
+	s.setAddingAt(currentTime, addingAt)
 
-		if b.Time <= currentTime {
-			itemBuilt[b.ItemID]++
-			power := m.GetPower(itemBought[b.ItemID])
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(power, big.NewInt(currentTime-b.Time)))
-			totalPower.Add(totalPower, power)
-			itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-		} else {
-			buyingAt[b.Time] = append(buyingAt[b.Time], b)
+	// simulationWindow 以内に建つものだけ見ればよい
+	for _, p := range e.pending {
+		if p.Time > currentTime+simulationWindow {
+			break
 		}
+		buyingAt[p.Time] = append(buyingAt[p.Time], p)
 	}
 
 	for _, m := range mItems {
-		itemPower0[m.ItemID] = big2exp(itemPower[m.ItemID])
-		itemBuilt0[m.ItemID] = itemBuilt[m.ItemID]
-		price := m.GetPrice(itemBought[m.ItemID] + 1)
-		itemPrice[m.ItemID] = price
-		if 0 <= totalMilliIsu.Cmp(new(big.Int).Mul(price, big.NewInt(1000))) {
+		itemPower0[m.ItemID] = big2exp(ps.itemEffectivePower(m.ItemID))
+		if 0 <= totalMilliIsu.Cmp(new(big.Int).Mul(itemPrice[m.ItemID], big.NewInt(1000))) {
 			itemOnSale[m.ItemID] = 0 // 0 は 時刻 currentTime で購入可能であることを表す
 		}
 	}
@@ -549,55 +715,96 @@ func calcStatus(roomName string, currentTime int64, mItems map[int]mItem, buying
 		itemPrice1000[itemID] = new(big.Int).Mul(itemPrice[itemID], big.NewInt(1000))
 	}
 
-	// currentTime から 1000 ミリ秒先までシミュレーションする
-	for t := currentTime + 1; t <= currentTime+1000; t++ {
-		totalMilliIsu.Add(totalMilliIsu, totalPower)
-		updated := false
+	// currentTime から simulationWindow 先までシミュレーションする。
+	// adding と buying が起きる時刻の間は totalPower が一定なので、その時刻だけを順に見ていく
+	endTime := currentTime + simulationWindow
+	events := []int64{}
+	for t := range addingAt {
+		if t <= endTime {
+			events = append(events, t)
+		}
+	}
+	for t := range buyingAt {
+		if _, ok := addingAt[t]; !ok {
+			events = append(events, t)
+		}
+	}
+	if _, ok := buyingAt[endTime]; !ok {
+		if _, ok := addingAt[endTime]; !ok {
+			events = append(events, endTime)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+
+	prev := currentTime
+	for _, t := range events {
+		d := t - prev
 
 		// 時刻 t で発生する adding を計算する
-		if a, ok := addingAt[t]; ok {
-			updated = true
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(a.IsuVal, big.NewInt(1000)))
+		addMilliIsu := new(big.Int)
+		a, added := addingAt[t]
+		if added {
+			addMilliIsu.Mul(a.IsuVal, big.NewInt(1000))
+		}
+
+		// (prev, t) の間は totalMilliIsu + totalPower * k なので、届く時刻を割り算で求める。
+		// 時刻 t ちょうどでは adding も足したうえで判定する
+		for itemID := range mItems {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if totalPower.Sign() > 0 {
+				need := new(big.Int).Sub(itemPrice1000[itemID], totalMilliIsu)
+				k := need.Add(need, totalPower)
+				k.Sub(k, big.NewInt(1))
+				k.Quo(k, totalPower)
+				if k.Cmp(big.NewInt(d)) < 0 {
+					itemOnSale[itemID] = prev + k.Int64()
+					continue
+				}
+			}
+			atT := new(big.Int).Mul(totalPower, big.NewInt(d))
+			atT.Add(atT, totalMilliIsu)
+			atT.Add(atT, addMilliIsu)
+			if 0 <= atT.Cmp(itemPrice1000[itemID]) {
+				itemOnSale[itemID] = t
+			}
 		}
 
+		totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(totalPower, big.NewInt(d)))
+		totalMilliIsu.Add(totalMilliIsu, addMilliIsu)
+		prev = t
+
 		// 時刻 t で発生する buying を計算する
-		if _, ok := buyingAt[t]; ok {
-			updated = true
+		_, built := buyingAt[t]
+		if built {
 			updatedID := map[int]bool{}
 			for _, b := range buyingAt[t] {
-				m := mItems[b.ItemID]
 				updatedID[b.ItemID] = true
-				itemBuilt[b.ItemID]++
-				power := m.GetPower(b.Ordinal)
-				itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-				totalPower.Add(totalPower, power)
+				ps.build(b)
+				// boost の対象も Power が変わる
+				if boost := mItems[b.ItemID].Boost; boost != nil {
+					for _, id := range boost.Targets {
+						updatedID[id] = true
+					}
+				}
 			}
 			for id := range updatedID {
 				itemBuilding[id] = append(itemBuilding[id], Building{
 					Time:       t,
-					CountBuilt: itemBuilt[id],
-					Power:      big2exp(itemPower[id]),
+					CountBuilt: ps.itemBuilt[id],
+					Power:      big2exp(ps.itemEffectivePower(id)),
 				})
 			}
 		}
 
-		if updated {
+		if added || built {
 			schedule = append(schedule, Schedule{
 				Time:       t,
 				MilliIsu:   big2exp(totalMilliIsu),
 				TotalPower: big2exp(totalPower),
 			})
 		}
-
-		// 時刻 t で購入可能になったアイテムを記録する
-		for itemID := range mItems {
-			if _, ok := itemOnSale[itemID]; ok {
-				continue
-			}
-			if 0 <= totalMilliIsu.Cmp(itemPrice1000[itemID]) {
-				itemOnSale[itemID] = t
-			}
-		}
 	}
 
 	gsAdding := []Adding{}
@@ -633,26 +840,43 @@ func calcStatus(roomName string, currentTime int64, mItems map[int]mItem, buying
 	}, nil
 }
 
+// これ以上書き込めないクライアントは切断する
+const writeTimeout = 5 * time.Second
+
+func writeJSON(ws *websocket.Conn, v interface{}) error {
+	ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteJSON(v)
+}
+
 func serveGameConn(ws *websocket.Conn, roomName string) {
-	log.Println(ws.RemoteAddr(), "serveGameConn", roomName)
+	connLog := logs.with("room", roomName, "remote", ws.RemoteAddr().String())
+	connLog.info("connected")
 	defer ws.Close()
+	atomic.AddInt64(&connCount, 1)
+	defer atomic.AddInt64(&connCount, -1)
 
-	status, err := getStatus(roomName)
+	r := ac.room(roomName)
+	sub, status, err := r.subscribe()
 	if err != nil {
-		printError(err)
+		connLog.error("failed to subscribe", "err", err)
 		return
 	}
+	defer r.unsubscribe(sub)
 
-	err = ws.WriteJSON(status)
-	if err != nil {
-		printError(err)
-		return
+	if status != nil {
+		err = writeJSON(ws, status)
+		if err != nil {
+			connLog.info("failed to write", "err", err)
+			return
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	chReq := make(chan GameRequest)
+	stop := shutdown.stopped()
+	limiter := newIsuLimiter(addRate)
 
 	go func() {
 		defer cancel()
@@ -660,7 +884,7 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 			req := GameRequest{}
 			err := ws.ReadJSON(&req)
 			if err != nil {
-				printError(err)
+				connLog.info("disconnected", "err", err)
 				return
 			}
 
@@ -672,60 +896,116 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 		}
 	}()
 
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-
 	for {
 		select {
 		case req := <-chReq:
-			log.Println(req)
+			start := time.Now()
+			sp := startTrace("serveGameConn")
+			sp.set("room", roomName)
+			sp.set("action", req.Action)
+			sp.set("request_id", req.RequestID)
+			reqLog := connLog.with("request_id", req.RequestID, "client_id", req.ClientID, "action", req.Action)
+			if id := sp.traceID(); id != "" {
+				reqLog = reqLog.with("trace_id", id)
+			}
+			// 一番多いログなので debug にしておき、出すときも間引く
+			reqLog.debug("request", "time", req.Time, "isu", req.Isu, "item_id", req.ItemID, "count_bought", req.CountBought)
 
-			success := false
+			var fn func(s *roomState) error
+			var reqErr error
 			switch req.Action {
 			case "addIsu":
-				success = addIsu(roomName, str2big(req.Isu), req.Time)
+				var isu *big.Int
+				isu, reqErr = parseIsu(req.Isu)
+				fn = func(s *roomState) error {
+					// 送り直しで制限にかからないように、実行するときだけ数える
+					return s.addIsuAt(isu, req.Time, limiter)
+				}
 			case "buyItem":
-				success = buyItem(roomName, req.ItemID, req.CountBought, req.Time)
+				fn = func(s *roomState) error {
+					return s.buyItem(req.ItemID, req.CountBought, req.buyQuantity(), req.BuyMax, req.Time)
+				}
+			case "sellItem":
+				fn = func(s *roomState) error {
+					return s.sellItem(req.ItemID, req.CountBought, req.Time)
+				}
 			default:
-				log.Println("Invalid Action")
+				reqLog.warn("invalid action")
 				return
 			}
 
-			if success {
+			var status *GameStatus
+			replayed := false
+			if reqErr == nil {
+				key := requestKey{req.ClientID, req.RequestID}
+				status, replayed, reqErr = runTracedAction(roomName, sub, key, sp, reqLog, fn)
+			}
+			if replayed {
+				reqLog.info("already done")
+				sp.set("replayed", true)
+			}
+
+			success := reqErr == nil
+			if success && !replayed {
 				// GameResponse を返却する前に 反映済みの GameStatus を返す
-				status, err := getStatus(roomName)
-				if err != nil {
-					printError(err)
+				if status == nil {
 					return
 				}
 
-				err = ws.WriteJSON(status)
+				wsp := sp.child("writeStatus")
+				err := writeJSON(ws, status)
+				wsp.end()
 				if err != nil {
-					printError(err)
+					reqLog.info("failed to write", "err", err)
 					return
 				}
 			}
 
-			err := ws.WriteJSON(GameResponse{
+			res := GameResponse{
 				RequestID: req.RequestID,
 				IsSuccess: success,
-			})
+				TraceID:   sp.traceID(),
+			}
+			result := "success"
+			if reqErr != nil {
+				e := toGameError(reqErr)
+				reqLog.info("rejected", "code", e.Code)
+				res.ErrorCode = e.Code
+				res.Error = e.Message
+				result = e.Code
+			}
+			metricActions.inc(req.Action, result)
+			metricActionDuration.since(start, req.Action)
+			sp.set("result", result)
+			err := writeJSON(ws, res)
+			sp.end()
 			if err != nil {
-				printError(err)
+				reqLog.info("failed to write", "err", err)
 				return
 			}
-		case <-ticker.C:
-			status, err := getStatus(roomName)
+		case status := <-sub.ch:
+			err := writeJSON(ws, status)
 			if err != nil {
-				printError(err)
+				connLog.info("failed to write", "err", err)
 				return
 			}
-
-			err = ws.WriteJSON(status)
+		case hint := <-sub.moved:
+			// 移し先を教えて切る。クライアントは同じ client_id でつなぎ直す
+			connLog.info("room is moved", "host", hint.Host)
+			err := writeJSON(ws, struct {
+				Reconnect *reconnectHint `json:"reconnect"`
+			}{hint})
 			if err != nil {
-				printError(err)
-				return
+				connLog.info("failed to write", "err", err)
 			}
+			return
+		case <-stop:
+			// 処理中のリクエストは返し終わっている。つなぎ直す先を教えてから close frame を送る
+			connLog.info("closing for shutdown")
+			if err := closeForShutdown(ws, shutdownHint(getHostName(roomName), roomName)); err != nil {
+				connLog.info("failed to write", "err", err)
+			}
+			return
 		case <-ctx.Done():
 			return
 		}
@@ -2,19 +2,68 @@ package main
 
 import (
 	"math/big"
+	"math/rand"
+	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+const testRoom = "test"
+
+// MySQL なしで calcStatus を動かせるように、メモリ上の部屋に addings を積む
+func setupRoom(addings []Adding) *roomState {
+	r := newRoomState(testRoom, nil)
+	for _, a := range addings {
+		r.addIsu(str2big(a.Isu), a.Time)
+	}
+	return r
+}
+
+// store と ac を s と l で作り直したものに差し替える。
+// 返した関数で部屋の goroutine と定期の DumpFile を止め、元の store と ac に戻す。
+// 移した部屋と移してきた部屋は忘れる
+func newTestCache(t *testing.T, s Storage, l *addingLog) func() {
+	oldStore, oldAC := store, ac
+	store = s
+	c, err := newAddingCache(s, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac = c
+	return func() {
+		c.eachRoom(func(s *roomState) {
+			s.expired = true
+		})
+		if l != nil {
+			select {
+			case <-c.stopped:
+				// Close 済み
+			default:
+				close(c.stop)
+				<-c.stopped
+			}
+		}
+		placements.clear()
+		store, ac = oldStore, oldAC
+	}
+}
+
+// trace もログの差し替えもせずに runTracedAction を呼ぶ
+func runAction(roomName string, sub *subscriber, key requestKey, fn func(s *roomState) error) (*GameStatus, bool, error) {
+	return runTracedAction(roomName, sub, key, nil, nil, fn)
+}
+
 func TestStatusEmpty(t *testing.T) {
 	assert := assert.New(t)
 
 	mItems := map[int]mItem{}
 	addings := []Adding{}
 	buyings := []Buying{}
+	r := setupRoom(addings)
 
-	s, err := calcStatus(0, mItems, addings, buyings)
+	s, err := calcStatus(r, 0, newEconomy(mItems, buyings))
 
 	assert.Nil(err)
 	assert.Empty(s.Adding)
@@ -37,8 +86,9 @@ func TestStatusAdd(t *testing.T) {
 		Adding{Time: 300, Isu: "1234567890123456789"},
 	}
 	buyings := []Buying{}
+	r := setupRoom(addings)
 
-	s, err := calcStatus(0, mItems, addings, buyings)
+	s, err := calcStatus(r, 0, newEconomy(mItems, buyings))
 	assert.Nil(err)
 	assert.Len(s.Adding, 3)
 	assert.Len(s.Schedule, 4)
@@ -59,7 +109,7 @@ func TestStatusAdd(t *testing.T) {
 	assert.Equal(Exponential{123456789012345, 7}, s.Schedule[3].MilliIsu)
 	assert.Equal(Exponential{0, 0}, s.Schedule[3].TotalPower)
 
-	s, err = calcStatus(500, mItems, addings, buyings)
+	s, err = calcStatus(r, 500, newEconomy(mItems, buyings))
 	assert.Nil(err)
 	assert.Len(s.Adding, 0)
 	assert.Len(s.Schedule, 1)
@@ -85,7 +135,8 @@ func TestStatusBuySingle(t *testing.T) {
 	buyings := []Buying{
 		Buying{ItemID: 1, Ordinal: 1, Time: 100},
 	}
-	s, err := calcStatus(0, mItems, addings, buyings)
+	r := setupRoom(addings)
+	s, err := calcStatus(r, 0, newEconomy(mItems, buyings))
 	assert.Nil(err)
 	assert.Len(s.Adding, 0)
 	assert.Len(s.Schedule, 2)
@@ -111,8 +162,9 @@ func TestOnSale(t *testing.T) {
 	mItems := map[int]mItem{1: x}
 	addings := []Adding{Adding{Time: 0, Isu: "1"}}
 	buyings := []Buying{Buying{ItemID: 1, Ordinal: 1, Time: 0}}
+	r := setupRoom(addings)
 
-	s, err := calcStatus(1, mItems, addings, buyings)
+	s, err := calcStatus(r, 1, newEconomy(mItems, buyings))
 	assert.Nil(err)
 	assert.Len(s.Adding, 0)
 	assert.Len(s.Schedule, 1)
@@ -152,8 +204,9 @@ func TestStatusBuy(t *testing.T) {
 		Buying{ItemID: 2, Ordinal: 1, Time: 300},
 		Buying{ItemID: 2, Ordinal: 2, Time: 2001},
 	}
+	r := setupRoom(addings)
 
-	s, err := calcStatus(0, mItems, addings, buyings)
+	s, err := calcStatus(r, 0, newEconomy(mItems, buyings))
 	assert.Nil(err)
 	assert.Len(s.Adding, 0)
 	assert.Len(s.Schedule, 4)
@@ -222,3 +275,365 @@ func TestConv(t *testing.T) {
 	assert.Equal(Exponential{1234, 0}, big2exp(str2big("1234")))
 	assert.Equal(Exponential{111111111111110, 5}, big2exp(str2big("11111111111111000000")))
 }
+
+// 部屋ごとの goroutine で処理されるので、並行に addIsu しても取りこぼさない
+func TestRoomConcurrentAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+
+	reqTime := getCurrentTime() + 10000
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			for j := 0; j < 100; j++ {
+				runAction([]string{"a", "b"}[i%2], nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), reqTime, nil) })
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	for _, name := range []string{"a", "b"} {
+		var total *big.Int
+		ac.room(name).do(func(s *roomState) {
+			total = s.getTotal(reqTime)
+		})
+		assert.Equal(0, total.Cmp(big.NewInt(500*1000)))
+	}
+}
+
+// まとめ買いは全部買えるときだけ買い、buyMax なら買えるところまで買う
+func TestBuyQuantity(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	// item 1 の n 個目は n+1 isu
+	reqTime := getCurrentTime() + 10000
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(10), reqTime, nil) })
+	assert.Nil(err)
+
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.buyItem(1, 0, 4, false, reqTime) })
+	assert.Equal(errNotEnough, err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.buyItem(1, 0, 3, false, reqTime) })
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.buyItem(1, 3, 2, false, reqTime) })
+	assert.Equal(errNotEnough, err)
+
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(10), reqTime, nil) })
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.buyItem(1, 3, maxBuyQuantity, true, reqTime) })
+	assert.Nil(err)
+
+	// 残り 1 + 10 isu で 4, 5 個目まで買える
+	buyings, err := store.Buyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 5)
+	var total *big.Int
+	ac.room("a").do(func(s *roomState) {
+		total = s.getTotal(reqTime)
+		total.Add(total, s.eco.milliIsuAt(reqTime))
+	})
+	assert.Equal(0, total.Cmp(big.NewInt(0)), total.String())
+
+	assert.Equal(1, (&GameRequest{}).buyQuantity())
+	assert.Equal(maxBuyQuantity, (&GameRequest{BuyMax: true}).buyQuantity())
+	assert.Equal(7, (&GameRequest{Quantity: 7, BuyMax: true}).buyQuantity())
+}
+
+// 売ると返金され、読み直しても同じ状態になる
+func TestSellItem(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	now := getCurrentTime()
+	assert.Nil(store.AddBuyings([]Buying{
+		{RoomName: "a", ItemID: 1, Ordinal: 1, Time: now - 5000},
+		{RoomName: "a", ItemID: 1, Ordinal: 2, Time: now - 3000},
+	}))
+	reqTime := now + 10000
+
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.sellItem(1, 1, reqTime) })
+	assert.Equal(errNotLastItem, err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.sellItem(2, 0, reqTime) })
+	assert.Equal(errNotLastItem, err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.sellItem(1, 2, reqTime) })
+	assert.Nil(err)
+
+	buyings, err := store.Buyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 1)
+	sales, err := store.Sales("a")
+	assert.Nil(err)
+	assert.Len(sales, 1)
+	// item 1 の 2 個目は 3 isu
+	assert.Equal("1500", sales[0].Refund)
+
+	// 買い直したものはまだ建っていないので売れない
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(100), reqTime, nil) })
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.buyItem(1, 1, 1, false, reqTime) })
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.sellItem(1, 2, reqTime) })
+	assert.Equal(errNotBuilt, err)
+
+	ac.room("a").do(func(s *roomState) {
+		at := reqTime + 2000
+		want := s.eco.milliIsuAt(at)
+		wantPower := new(big.Int).Set(s.eco.totalPower)
+		wantBought := s.eco.itemBought[1]
+
+		s.eco = nil
+		e, err := s.loadEconomy()
+		assert.Nil(err)
+		assert.Equal(0, e.milliIsuAt(at).Cmp(want), e.milliIsuAt(at).String())
+		assert.Equal(0, e.totalPower.Cmp(wantPower))
+		assert.Equal(wantBought, e.itemBought[1])
+	})
+}
+
+// 同じ client_id, request_id で成功したものは実行し直さない
+func TestRunActionReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	n := 0
+	fail := true
+	fn := func(s *roomState) error {
+		n++
+		if fail {
+			return errNotEnough
+		}
+		return nil
+	}
+	key := requestKey{"c1", 1}
+
+	_, replayed, err := runAction("a", nil, key, fn)
+	assert.False(replayed)
+	assert.Equal(errNotEnough, err)
+
+	// 失敗したものはもう一度実行する
+	fail = false
+	_, replayed, err = runAction("a", nil, key, fn)
+	assert.False(replayed)
+	assert.Nil(err)
+
+	_, replayed, err = runAction("a", nil, key, fn)
+	assert.True(replayed)
+	assert.Nil(err)
+	assert.Equal(2, n)
+
+	// 別のクライアントの同じ request_id は別物
+	_, replayed, _ = runAction("a", nil, requestKey{"c2", 1}, fn)
+	assert.False(replayed)
+	// client_id がなければ毎回実行する
+	runAction("a", nil, requestKey{"", 1}, fn)
+	runAction("a", nil, requestKey{"", 1}, fn)
+	assert.Equal(5, n)
+}
+
+// 成功した addIsu の結果は、送った本人以外の購読者に配られる
+func TestRoomPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	r := ac.room("a")
+	me, _, err := r.subscribe()
+	assert.Nil(err)
+	other, _, err := r.subscribe()
+	assert.Nil(err)
+
+	status, _, err := runAction("a", me, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Nil(err)
+	assert.NotNil(status)
+	assert.Len(status.Adding, 1)
+
+	select {
+	case s := <-other.ch:
+		assert.Len(s.Adding, 1)
+	default:
+		t.Fatal("status is not published")
+	}
+	select {
+	case s := <-me.ch:
+		// ticker で配られた分が来ることはある
+		assert.NotNil(s)
+	default:
+	}
+}
+
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool { return items[i].ItemID < items[j].ItemID })
+}
+
+// 購入のたびに差分で更新したものと、最初から全部読んだものが一致する
+func TestEconomyIncremental(t *testing.T) {
+	assert := assert.New(t)
+
+	mItems := map[int]mItem{
+		1: {ItemID: 1, Power1: 1, Power2: 1, Power3: 3, Power4: 2, Price1: 1, Price2: 1, Price3: 7, Price4: 6},
+		2: {ItemID: 2, Power1: 1, Power2: 1, Power3: 7, Power4: 6, Price1: 1, Price2: 1, Price3: 3, Price4: 2},
+	}
+	buyings := []Buying{
+		{ItemID: 1, Ordinal: 1, Time: 100},
+		{ItemID: 2, Ordinal: 1, Time: 300},
+		{ItemID: 1, Ordinal: 2, Time: 250},
+		{ItemID: 2, Ordinal: 2, Time: 1500},
+	}
+
+	e := newEconomy(mItems, nil)
+	e.advance(50)
+	e.buy(buyings[0])
+	e.advance(120)
+	e.buy(buyings[1])
+	e.buy(buyings[2])
+	e.advance(400)
+	e.buy(buyings[3])
+
+	for _, now := range []int64{1000, 1400, 2600} {
+		got, err := calcStatus(setupRoom(nil), now, e)
+		assert.Nil(err)
+		want, err := calcStatus(setupRoom(nil), now, newEconomy(mItems, buyings))
+		assert.Nil(err)
+		assert.Equal(want.Schedule, got.Schedule)
+		sortItems(want.Items)
+		sortItems(got.Items)
+		assert.Equal(want.Items, got.Items)
+	}
+}
+
+// 1ミリ秒ずつ進める素朴なシミュレーション。calcStatus と結果を比べるために使う
+func calcStatusNaive(currentTime int64, mItems map[int]mItem, addings []Adding, buyings []Buying) ([]Schedule, map[int][]Building, map[int]int64) {
+	totalMilliIsu := big.NewInt(0)
+	totalPower := big.NewInt(0)
+	itemPower := map[int]*big.Int{}
+	itemBought := map[int]int{}
+	itemBuilt := map[int]int{}
+	itemBuilding := map[int][]Building{}
+	itemOnSale := map[int]int64{}
+	addingAt := map[int64]*big.Int{}
+	buyingAt := map[int64][]Buying{}
+
+	for itemID := range mItems {
+		itemPower[itemID] = big.NewInt(0)
+		itemBuilding[itemID] = []Building{}
+	}
+	for _, a := range addings {
+		v := new(big.Int).Mul(str2big(a.Isu), big.NewInt(1000))
+		if a.Time <= currentTime {
+			totalMilliIsu.Add(totalMilliIsu, v)
+		} else {
+			addingAt[a.Time] = v
+		}
+	}
+	for _, b := range buyings {
+		m := mItems[b.ItemID]
+		itemBought[b.ItemID]++
+		totalMilliIsu.Sub(totalMilliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), big.NewInt(1000)))
+		if b.Time <= currentTime {
+			itemBuilt[b.ItemID]++
+			power := m.GetPower(b.Ordinal)
+			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(power, big.NewInt(currentTime-b.Time)))
+			totalPower.Add(totalPower, power)
+			itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
+		} else {
+			buyingAt[b.Time] = append(buyingAt[b.Time], b)
+		}
+	}
+	price1000 := map[int]*big.Int{}
+	for itemID, m := range mItems {
+		price1000[itemID] = new(big.Int).Mul(m.GetPrice(itemBought[itemID]+1), big.NewInt(1000))
+		if 0 <= totalMilliIsu.Cmp(price1000[itemID]) {
+			itemOnSale[itemID] = 0
+		}
+	}
+
+	schedule := []Schedule{{Time: currentTime, MilliIsu: big2exp(totalMilliIsu), TotalPower: big2exp(totalPower)}}
+	for t := currentTime + 1; t <= currentTime+1000; t++ {
+		totalMilliIsu.Add(totalMilliIsu, totalPower)
+		updated := false
+		if v, ok := addingAt[t]; ok {
+			updated = true
+			totalMilliIsu.Add(totalMilliIsu, v)
+		}
+		if bs, ok := buyingAt[t]; ok {
+			updated = true
+			updatedID := map[int]bool{}
+			for _, b := range bs {
+				updatedID[b.ItemID] = true
+				itemBuilt[b.ItemID]++
+				m := mItems[b.ItemID]
+				power := m.GetPower(b.Ordinal)
+				itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
+				totalPower.Add(totalPower, power)
+			}
+			for id := range updatedID {
+				itemBuilding[id] = append(itemBuilding[id], Building{Time: t, CountBuilt: itemBuilt[id], Power: big2exp(itemPower[id])})
+			}
+		}
+		if updated {
+			schedule = append(schedule, Schedule{Time: t, MilliIsu: big2exp(totalMilliIsu), TotalPower: big2exp(totalPower)})
+		}
+		for itemID := range mItems {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if 0 <= totalMilliIsu.Cmp(price1000[itemID]) {
+				itemOnSale[itemID] = t
+			}
+		}
+	}
+	return schedule, itemBuilding, itemOnSale
+}
+
+// イベントの時刻だけを見るシミュレーションが、1ミリ秒ずつ進めたものと同じ結果になる
+func TestStatusSameAsNaive(t *testing.T) {
+	assert := assert.New(t)
+	rnd := rand.New(rand.NewSource(1))
+
+	mItems := map[int]mItem{
+		1: {ItemID: 1, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1},
+		2: {ItemID: 2, Power1: 0, Power2: 1, Power3: 1, Power4: 1, Price1: 0, Price2: 1, Price3: 2, Price4: 1},
+		3: {ItemID: 3, Power1: 1, Power2: 10, Power3: 0, Power4: 2, Price1: 1, Price2: 3, Price3: 1, Price4: 2},
+		4: {ItemID: 4, Power1: 1, Power2: 24, Power3: 1, Power4: 2, Price1: 1, Price2: 10, Price3: 0, Price4: 3},
+	}
+
+	for i := 0; i < 50; i++ {
+		currentTime := int64(rnd.Intn(2000))
+		addings := []Adding{}
+		for t := int64(0); t < 3000; t += int64(rnd.Intn(300) + 1) {
+			addings = append(addings, Adding{Time: t, Isu: strconv.Itoa(rnd.Intn(100000))})
+		}
+		buyings := []Buying{}
+		for itemID := range mItems {
+			n := rnd.Intn(4)
+			for ord := 1; ord <= n; ord++ {
+				buyings = append(buyings, Buying{ItemID: itemID, Ordinal: ord, Time: int64(rnd.Intn(3000))})
+			}
+		}
+
+		wantSchedule, wantBuilding, wantOnSale := calcStatusNaive(currentTime, mItems, addings, buyings)
+
+		s, err := calcStatus(setupRoom(addings), currentTime, newEconomy(mItems, buyings))
+		assert.Nil(err)
+		assert.Equal(wantSchedule, s.Schedule)
+		for _, item := range s.Items {
+			assert.Equal(wantBuilding[item.ItemID], item.Building)
+		}
+		onSale := map[int]int64{}
+		for _, o := range s.OnSale {
+			onSale[o.ItemID] = o.Time
+		}
+		assert.Equal(wantOnSale, onSale)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DumpFile がこれだけ成功していなければ ready でなくする
+func maxDumpAge() time.Duration {
+	return 3 * snapshotInterval
+}
+
+// /healthz と /readyz で返すプロセスの状態
+var health = &healthState{mux: &sync.Mutex{}, startedAt: time.Now()}
+
+// 接続中の WebSocket の数
+var connCount int64
+
+type healthState struct {
+	mux *sync.Mutex
+
+	startedAt  time.Time
+	started    bool // 起動時の replay と設定の読み込みが終わった
+	stopping   bool // SIGTERM を受けて止めている
+	dbUsed     bool
+	dbErr      string // 最後の db.Ping のエラー
+	dbAttempts int
+
+	lastDump time.Time
+	dumpErr  string
+}
+
+type healthReport struct {
+	Status      string    `json:"status"` // ok か not_ready
+	Started     bool      `json:"started"`
+	Stopping    bool      `json:"stopping,omitempty"`
+	Uptime      float64   `json:"uptime_sec"`
+	DB          *dbReport `json:"db,omitempty"`
+	LastDump    int64     `json:"last_dump,omitempty"` // ミリ秒
+	DumpAge     float64   `json:"dump_age_sec,omitempty"`
+	DumpError   string    `json:"dump_error,omitempty"`
+	Rooms       int       `json:"rooms"`
+	Connections int64     `json:"connections"`
+	Reasons     []string  `json:"reasons,omitempty"` // not_ready の理由
+}
+
+type dbReport struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"` // 起動時に接続を試した回数
+}
+
+func (h *healthState) setStarted() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.started = true
+}
+
+func (h *healthState) setStopping() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.stopping = true
+}
+
+func (h *healthState) isStarted() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.started
+}
+
+func (h *healthState) setDB(err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.dbUsed = true
+	h.dbAttempts++
+	h.dbErr = ""
+	if err != nil {
+		h.dbErr = err.Error()
+	}
+}
+
+func (h *healthState) setDumped(err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if err != nil {
+		h.dumpErr = err.Error()
+		return
+	}
+	h.lastDump = time.Now()
+	h.dumpErr = ""
+}
+
+// 今の DB への疎通も確かめてから状態を集める。
+// db と ac は起動中に差し替わるので、setDB や setStarted の後でだけ触る
+func (h *healthState) report(now time.Time) *healthReport {
+	h.mux.Lock()
+	dbUsed, started := h.dbUsed, h.started
+	h.mux.Unlock()
+
+	var pingErr error
+	if dbUsed && db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		pingErr = db.PingContext(ctx)
+		cancel()
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	rep := &healthReport{
+		Status:      "ok",
+		Started:     started,
+		Stopping:    h.stopping,
+		Uptime:      now.Sub(h.startedAt).Seconds(),
+		DumpError:   h.dumpErr,
+		Connections: atomic.LoadInt64(&connCount),
+	}
+	notReady := func(reason string) {
+		rep.Status = "not_ready"
+		rep.Reasons = append(rep.Reasons, reason)
+	}
+
+	if !started {
+		notReady("starting")
+	}
+	if h.stopping {
+		notReady("stopping")
+	}
+	if dbUsed {
+		rep.DB = &dbReport{OK: true, Attempts: h.dbAttempts}
+		if db == nil {
+			rep.DB.OK = false
+			rep.DB.Error = h.dbErr
+		} else if pingErr != nil {
+			rep.DB.OK = false
+			rep.DB.Error = pingErr.Error()
+		}
+		if !rep.DB.OK {
+			notReady("db")
+		}
+	}
+	if started && ac != nil {
+		rep.Rooms = ac.roomCount()
+		if ac.log != nil {
+			// 最初の DumpFile までは起動した時刻から数える
+			last := h.lastDump
+			if last.IsZero() {
+				last = h.startedAt
+			} else {
+				rep.LastDump = last.UnixNano() / int64(time.Millisecond)
+			}
+			rep.DumpAge = now.Sub(last).Seconds()
+			if now.Sub(last) > maxDumpAge() {
+				notReady("dump")
+			}
+		}
+	}
+	return rep
+}
+
+// プロセスが生きていれば 200 を返す。中身は /readyz と同じ
+func getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health.report(time.Now()))
+}
+
+// ロードバランサ向け。部屋を受けられないときは 503 を返す
+func getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	rep := health.report(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if rep.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rep)
+}
+
+// 起動が終わるまではヘルスチェック以外に 503 を返す
+func waitStartup(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz":
+		default:
+			if !health.isStarted() {
+				http.Error(w, "starting", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
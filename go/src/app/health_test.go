@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthReport(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	ac.room("a")
+
+	now := time.Now()
+	h := &healthState{mux: &sync.Mutex{}, startedAt: now}
+	rep := h.report(now)
+	assert.Equal("not_ready", rep.Status)
+	assert.Equal([]string{"starting"}, rep.Reasons)
+	assert.Equal(0, rep.Rooms)
+
+	h.setStarted()
+	rep = h.report(now)
+	assert.Equal("ok", rep.Status)
+	assert.Equal(1, rep.Rooms)
+
+	// 起動してからスナップショットが書けていない
+	rep = h.report(now.Add(maxDumpAge() + time.Second))
+	assert.Equal("not_ready", rep.Status)
+	assert.Equal([]string{"dump"}, rep.Reasons)
+
+	h.setDumped(errors.New("disk full"))
+	rep = h.report(now.Add(maxDumpAge() + time.Second))
+	assert.Equal("disk full", rep.DumpError)
+
+	h.setDumped(nil)
+	rep = h.report(time.Now())
+	assert.Equal("ok", rep.Status)
+	assert.Empty(rep.DumpError)
+	assert.NotZero(rep.LastDump)
+}
+
+func TestWaitStartup(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+
+	old := health
+	defer func() { health = old }()
+	health = &healthState{mux: &sync.Mutex{}, startedAt: time.Now()}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", getReadyzHandler)
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {})
+	h := waitStartup(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	assert.Equal(http.StatusServiceUnavailable, get("/items").Code)
+	w := get("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	var rep healthReport
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &rep))
+	assert.False(rep.Started)
+
+	health.setStarted()
+	assert.Equal(http.StatusOK, get("/items").Code)
+	assert.Equal(http.StatusOK, get("/readyz").Code)
+}
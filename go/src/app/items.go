@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 今使っているアイテムのマスタ。/admin/items/reload で差し替わるので getItems で読む
+var (
+	items    = defaultItems
+	itemsMux = &sync.RWMutex{}
+
+	// ISU_ITEMS の値。空ならデフォルト、"db" なら m_item テーブル、それ以外は JSON ファイルのパス
+	itemsSource string
+)
+
+func getItems() map[int]mItem {
+	itemsMux.RLock()
+	defer itemsMux.RUnlock()
+	return items
+}
+
+func loadItems(source string) (map[int]mItem, error) {
+	var list []mItem
+	switch source {
+	case "":
+		return defaultItems, nil
+	case "db":
+		if db == nil {
+			initDB()
+		}
+		err := db.Select(&list, "SELECT item_id, power1, power2, power3, power4, price1, price2, price3, price4 FROM m_item")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&list); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+
+	m := make(map[int]mItem, len(list))
+	for _, item := range list {
+		if item.Name == "" {
+			item.Name = defaultItems[item.ItemID].Name
+		}
+		if _, ok := m[item.ItemID]; ok {
+			return nil, fmt.Errorf("item %d: duplicated", item.ItemID)
+		}
+		m[item.ItemID] = item
+	}
+	if err := validateItems(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// クライアントは ItemID が 1 から順に並んでいる前提で表示するので、歯抜けは許さない
+func validateItems(m map[int]mItem) error {
+	if len(m) == 0 {
+		return fmt.Errorf("no items")
+	}
+	for id := 1; id <= len(m); id++ {
+		item, ok := m[id]
+		if !ok {
+			return fmt.Errorf("item %d: missing", id)
+		}
+		if err := validateFormula(item.PowerFormula, item.Power1, item.Power2, item.Power3, item.Power4); err != nil {
+			return fmt.Errorf("item %d: power: %v", id, err)
+		}
+		if err := validateFormula(item.PriceFormula, item.Price1, item.Price2, item.Price3, item.Price4); err != nil {
+			return fmt.Errorf("item %d: price: %v", id, err)
+		}
+		if item.Boost != nil {
+			if item.Boost.Percent < 0 {
+				return fmt.Errorf("item %d: boost: percent must not be negative", id)
+			}
+			for _, t := range item.Boost.Targets {
+				if _, ok := m[t]; !ok {
+					return fmt.Errorf("item %d: boost: unknown target %d", id, t)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateFormula(spec *formulaSpec, a, b, c, d int64) error {
+	if spec != nil {
+		return spec.validate()
+	}
+	return validateExp(a, b, c, d)
+}
+
+// 読み込みに失敗したら今のマスタのまま。
+// 値段が変わるので、各部屋の economy は次に使うときに読み直させる
+func reloadItems() (map[int]mItem, error) {
+	m, err := loadItems(itemsSource)
+	if err != nil {
+		return nil, err
+	}
+
+	itemsMux.Lock()
+	items = m
+	itemsMux.Unlock()
+
+	ac.eachRoom(func(s *roomState) {
+		s.eco = nil
+	})
+	logs.info("loaded items", "count", len(m), "source", itemsSource)
+	return m, nil
+}
+
+func sortedItems(m map[int]mItem) []mItem {
+	list := make([]mItem, 0, len(m))
+	for _, item := range m {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+func getItemsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sortedItems(getItems()))
+}
+
+func postItemsReloadHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := reloadItems()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sortedItems(m))
+}
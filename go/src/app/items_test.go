@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeItemsFile(t *testing.T, body string) string {
+	f, err := ioutil.TempFile("", "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(body)
+	return f.Name()
+}
+
+func TestLoadItems(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := loadItems("../../items.json")
+	assert.Nil(err)
+	assert.Equal(defaultItems, m)
+
+	path := writeItemsFile(t, `[{"item_id": 1, "power4": 1, "price2": 1, "price4": 2}]`)
+	defer os.Remove(path)
+	m, err = loadItems(path)
+	assert.Nil(err)
+	item := m[1]
+	assert.Equal("おじいちゃん", item.Name)
+	assert.Equal(0, item.GetPrice(0).Cmp(big.NewInt(2)))
+}
+
+func TestLoadItemsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, body := range []string{
+		`[]`,
+		`[{"item_id": 2, "power4": 1, "price4": 1}]`,
+		`[{"item_id": 1, "power4": 1, "price4": 1}, {"item_id": 1, "power4": 1, "price4": 1}]`,
+		`[{"item_id": 1, "power4": 0, "price4": 1}]`,
+		`[{"item_id": 1, "power4": 1, "price1": -1, "price4": 1}]`,
+		`{"item_id": 1}`,
+	} {
+		path := writeItemsFile(t, body)
+		_, err := loadItems(path)
+		assert.NotNil(err, body)
+		os.Remove(path)
+	}
+}
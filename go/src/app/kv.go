@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 1ファイルに追記していくだけの key-value store.
+// 1回の Write はまとめて1フレームになるので、途中まで反映されることはない。
+type kvFile struct {
+	path    string
+	f       *os.File
+	data    map[string]string
+	garbage int // 上書き・削除されて不要になったエントリの数
+	mux     *sync.RWMutex
+	broken  bool // 書きかけのフレームを消せなかった。書き直すまで書かない
+}
+
+type kvOp struct {
+	Key    string `json:"k"`
+	Value  string `json:"v,omitempty"`
+	Delete bool   `json:"d,omitempty"`
+}
+
+// 不要なエントリがこれを超えて、かつ生きているエントリより多くなったら書き直す
+const kvCompactThreshold = 10000
+
+// 書き直すときの1フレームの大きさの目安。全部を1フレームにすると logMaxRecord を超えることがある
+const kvCompactFrameSize = 1 << 20
+
+func openKVFile(path string) (*kvFile, error) {
+	kv := &kvFile{path: path, data: make(map[string]string), mux: &sync.RWMutex{}}
+	err := replayFrames(path, func(payload []byte) error {
+		var ops []kvOp
+		if err := json.Unmarshal(payload, &ops); err != nil {
+			return err
+		}
+		kv.apply(ops)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	kv.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (kv *kvFile) apply(ops []kvOp) {
+	for _, op := range ops {
+		if _, ok := kv.data[op.Key]; ok {
+			kv.garbage++
+		}
+		if op.Delete {
+			delete(kv.data, op.Key)
+		} else {
+			kv.data[op.Key] = op.Value
+		}
+	}
+}
+
+func (kv *kvFile) Get(key string) (string, bool) {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	v, ok := kv.data[key]
+	return v, ok
+}
+
+func (kv *kvFile) Scan(prefix string, fn func(key, value string)) {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	for k, v := range kv.data {
+		if strings.HasPrefix(k, prefix) {
+			fn(k, v)
+		}
+	}
+}
+
+func (kv *kvFile) Write(ops []kvOp) error {
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	return kv.write(ops)
+}
+
+func (kv *kvFile) write(ops []kvOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	if kv.broken {
+		return errLogBroken
+	}
+	if err := appendFrame(kv.f, payload); err != nil {
+		kv.broken = err == errLogBroken
+		return err
+	}
+	if err := kv.f.Sync(); err != nil {
+		return err
+	}
+	kv.apply(ops)
+	// ここまでで書いたものは残っている。書き直せなくても garbage は減らないので次の write でやり直す
+	if kv.garbage > kvCompactThreshold && kv.garbage > len(kv.data) {
+		if err := kv.compact(); err != nil {
+			logs.error("failed to compact kv", "path", kv.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// ops を JSON の配列にして、size を超えないように分ける
+func kvFrames(ops []kvOp, size int) ([][]byte, error) {
+	frames := [][]byte{}
+	buf := []byte{'['}
+	for _, op := range ops {
+		b, err := json.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 1 && len(buf)+len(b)+2 > size {
+			frames = append(frames, append(buf, ']'))
+			buf = []byte{'['}
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, b...)
+	}
+	if len(buf) > 1 {
+		frames = append(frames, append(buf, ']'))
+	}
+	return frames, nil
+}
+
+// 生きているエントリだけを一時ファイルに書いて置き換える。
+// 置き換えるまでは元のファイルを読むので、何フレームに分けてもよい
+func (kv *kvFile) compact() error {
+	ops := make([]kvOp, 0, len(kv.data))
+	for k, v := range kv.data {
+		ops = append(ops, kvOp{Key: k, Value: v})
+	}
+	frames, err := kvFrames(ops, kvCompactFrameSize)
+	if err != nil {
+		return err
+	}
+
+	tmp := kv.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, payload := range frames {
+		if err := appendFrame(f, payload); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, kv.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(kv.path)); err != nil {
+		return err
+	}
+
+	nf, err := os.OpenFile(kv.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	kv.f.Close()
+	kv.f = nf
+	kv.garbage = 0
+	kv.broken = false
+	return nil
+}
+
+// 条件に合うキーをまとめて消して、ops を書く
+func (kv *kvFile) Replace(prefixes []string, ops []kvOp) error {
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+
+	keep := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		keep[op.Key] = true
+	}
+	all := []kvOp{}
+	for k := range kv.data {
+		if keep[k] {
+			continue
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				all = append(all, kvOp{Key: k, Delete: true})
+				break
+			}
+		}
+	}
+	return kv.write(append(all, ops...))
+}
+
+// MySQL なしで動かすためのストレージ。全部を1つの kvFile に置く。
+// 部屋の名前には \x00 も来るので、キーの各部分は url.PathEscape してからつなぐ
+//
+//	q\x00{room}\x00{time}            => que の値
+//	t\x00{room}                      => total の値
+//	b\x00{room}\x00{item}\x00{ordinal} => buying の time
+//	s\x00{room}\x00{seq}            => sale の JSON
+type kvStorage struct {
+	kv *kvFile
+}
+
+const kvSep = "\x00"
+
+func openKVStorage(path string) (*kvStorage, error) {
+	kv, err := openKVFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &kvStorage{kv}, nil
+}
+
+func kvKey(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = url.PathEscape(p)
+	}
+	return strings.Join(escaped, kvSep)
+}
+
+// kvKey で作ったキーを n 個に分けて戻す
+func kvSplit(key string, n int) ([]string, error) {
+	parts := strings.Split(key, kvSep)
+	if len(parts) != n {
+		return nil, fmt.Errorf("invalid kv key: %q", key)
+	}
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (s *kvStorage) LoadAddings() (*addingSnapshot, error) {
+	snap := newAddingSnapshot()
+	var err error
+	s.kv.Scan("q"+kvSep, func(k, v string) {
+		p, e := kvSplit(k, 3)
+		if e != nil {
+			err = e
+			return
+		}
+		t, e := strconv.ParseInt(p[2], 10, 64)
+		if e != nil {
+			err = e
+			return
+		}
+		snap.setQue(p[1], t, str2big(v))
+	})
+	s.kv.Scan("t"+kvSep, func(k, v string) {
+		p, e := kvSplit(k, 2)
+		if e != nil {
+			err = e
+			return
+		}
+		snap.total[p[1]] = str2big(v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *kvStorage) SaveAddings(snap *addingSnapshot) error {
+	ops := []kvOp{}
+	for name, v := range snap.que {
+		for t, val := range v {
+			ops = append(ops, kvOp{Key: kvKey("q", name, strconv.FormatInt(t, 10)), Value: val.String()})
+		}
+	}
+	for name, val := range snap.total {
+		ops = append(ops, kvOp{Key: kvKey("t", name), Value: val.String()})
+	}
+	return s.kv.Replace([]string{"q" + kvSep, "t" + kvSep}, ops)
+}
+
+func (s *kvStorage) Buyings(roomName string) ([]Buying, error) {
+	buyings := []Buying{}
+	var err error
+	s.kv.Scan(kvKey("b", roomName, ""), func(k, v string) {
+		p, e := kvSplit(k, 4)
+		if e != nil {
+			err = e
+			return
+		}
+		b := Buying{RoomName: roomName}
+		if b.ItemID, e = strconv.Atoi(p[2]); e != nil {
+			err = e
+		}
+		if b.Ordinal, e = strconv.Atoi(p[3]); e != nil {
+			err = e
+		}
+		if b.Time, e = strconv.ParseInt(v, 10, 64); e != nil {
+			err = e
+		}
+		buyings = append(buyings, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortBuyings(buyings)
+	return buyings, nil
+}
+
+// 1回の write は1フレームなので、途中まで書かれることはない
+func (s *kvStorage) AddBuyings(bs []Buying) error {
+	s.kv.mux.Lock()
+	defer s.kv.mux.Unlock()
+	ops := make([]kvOp, 0, len(bs))
+	seen := map[string]bool{}
+	for _, b := range bs {
+		key := kvKey("b", b.RoomName, strconv.Itoa(b.ItemID), strconv.Itoa(b.Ordinal))
+		if _, ok := s.kv.data[key]; ok || seen[key] {
+			return errAlreadyBought
+		}
+		seen[key] = true
+		ops = append(ops, kvOp{Key: key, Value: strconv.FormatInt(b.Time, 10)})
+	}
+	return s.kv.write(ops)
+}
+
+func (s *kvStorage) Sales(roomName string) ([]Sale, error) {
+	sales := []Sale{}
+	var err error
+	s.kv.Scan(kvKey("s", roomName, ""), func(k, v string) {
+		var sale Sale
+		if e := json.Unmarshal([]byte(v), &sale); e != nil {
+			err = e
+		}
+		sales = append(sales, sale)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSales(sales)
+	return sales, nil
+}
+
+func (s *kvStorage) SellBuying(sale Sale) error {
+	s.kv.mux.Lock()
+	defer s.kv.mux.Unlock()
+	key := kvKey("b", sale.RoomName, strconv.Itoa(sale.ItemID), strconv.Itoa(sale.Ordinal))
+	if _, ok := s.kv.data[key]; !ok {
+		return errNotBought
+	}
+	// 同じ時刻に売ったものもあるので、連番をキーにする
+	seq := 0
+	prefix := kvKey("s", sale.RoomName, "")
+	for k := range s.kv.data {
+		if strings.HasPrefix(k, prefix) {
+			seq++
+		}
+	}
+	v, err := json.Marshal(sale)
+	if err != nil {
+		return err
+	}
+	return s.kv.write([]kvOp{
+		{Key: key, Delete: true},
+		{Key: kvKey("s", sale.RoomName, strconv.Itoa(seq)), Value: string(v)},
+	})
+}
+
+func (s *kvStorage) DropRoom(roomName string) error {
+	return s.kv.Replace([]string{kvKey("b", roomName, ""), kvKey("s", roomName, "")}, nil)
+}
+
+func (s *kvStorage) Clean() error {
+	return s.kv.Replace([]string{""}, nil)
+}
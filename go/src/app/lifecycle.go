@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// これだけ何もされなかった部屋は片付ける。0 なら片付けない。ISU_ROOM_TTL で変えられる
+var roomTTL = 24 * time.Hour
+
+const roomSweepInterval = time.Minute
+
+// 片付けた部屋の最後の状態。archiveDir に部屋ごとに JSON で残す
+type roomArchive struct {
+	Room       string            `json:"room"`
+	ArchivedAt int64             `json:"archived_at"`
+	Total      string            `json:"total"` // ミリ椅子
+	Que        map[string]string `json:"que"`   // Time => isu
+	Buyings    []Buying          `json:"buyings"`
+	Sales      []Sale            `json:"sales"`
+}
+
+// archiveDir が空なら残さずに消す
+func (c *AddingCache) startSweeper(ttl time.Duration, archiveDir string) {
+	if ttl <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(roomSweepInterval)
+		for now := range t.C {
+			c.sweep(now.Add(-ttl), archiveDir)
+		}
+	}()
+}
+
+// before より後に何もされていない部屋を片付け、片付けた数を返す
+func (c *AddingCache) sweep(before time.Time, archiveDir string) int {
+	n := 0
+	for _, r := range c.allRooms() {
+		expired := false
+		r.tryDo(func(s *roomState) {
+			if len(s.subs) > 0 || s.active.After(before) {
+				return
+			}
+			if err := s.expire(archiveDir); err != nil {
+				s.lg.error("failed to expire room", "err", err)
+				return
+			}
+			expired = true
+		})
+		if expired {
+			c.remove(r)
+			n++
+		}
+	}
+	if n > 0 {
+		logs.info("expired rooms", "count", n)
+	}
+	return n
+}
+
+// 残してから store と log から消す。成功したら部屋の goroutine は終わる
+func (s *roomState) expire(archiveDir string) error {
+	if s.movedTo != "" {
+		// 中身はもう移してあるので、ここで消すと移した先の分まで消えることがある
+		s.expired = true
+		return nil
+	}
+	if archiveDir != "" {
+		if err := s.archive(archiveDir); err != nil {
+			return err
+		}
+	}
+	if err := store.DropRoom(s.name); err != nil {
+		return err
+	}
+	// ここで失敗しても、次のスナップショットにはこの部屋は入らない
+	s.appendLog(logRecord{Op: logOpDrop, Room: s.name})
+	s.expired = true
+	return nil
+}
+
+func (s *roomState) dump() (*roomArchive, error) {
+	buyings, err := store.Buyings(s.name)
+	if err != nil {
+		return nil, err
+	}
+	sales, err := store.Sales(s.name)
+	if err != nil {
+		return nil, err
+	}
+	a := &roomArchive{
+		Room:       s.name,
+		ArchivedAt: getCurrentTime(),
+		Total:      s.total.String(),
+		Que:        map[string]string{},
+		Buyings:    buyings,
+		Sales:      sales,
+	}
+	for t, v := range s.que {
+		a.Que[strconv.FormatInt(t, 10)] = v.String()
+	}
+	return a, nil
+}
+
+func (s *roomState) archive(dir string) error {
+	a, err := s.dump()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// 部屋の名前には / なども来るのでエスケープする
+	path := filepath.Join(dir, url.PathEscape(s.name)+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 片付けた r を一覧から外す。同じ名前で新しく作られた部屋は外さない
+func (c *AddingCache) remove(r *room) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.rooms[r.name] == r {
+		delete(c.rooms, r.name)
+	}
+}
+
+// 片付けられた r の代わりに新しい部屋を返す
+func (c *AddingCache) reopen(r *room) *room {
+	c.remove(r)
+	return c.room(r.name)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 放置された部屋は残してから消え、同じ名前で入り直すと空の部屋になる
+func TestRoomExpire(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+	dir := filepath.Dir(l.path)
+	archiveDir := filepath.Join(dir, "archive")
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	var err error
+
+	reqTime := getCurrentTime() + 10000
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(3), reqTime, nil) })
+	assert.Nil(err)
+	_, _, err = runAction("b", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(5), reqTime, nil) })
+	assert.Nil(err)
+	assert.Nil(store.AddBuyings([]Buying{{RoomName: "a", ItemID: 1, Ordinal: 1, Time: 1}}))
+
+	// 購読中の部屋は片付けない
+	rb := ac.room("b")
+	sub, _, err := rb.subscribe()
+	assert.Nil(err)
+
+	old := ac.room("a")
+	assert.Equal(1, ac.sweep(time.Now().Add(time.Second), archiveDir))
+	assert.Len(ac.allRooms(), 1)
+
+	buyings, err := store.Buyings("a")
+	assert.Nil(err)
+	assert.Empty(buyings)
+
+	b, err := ioutil.ReadFile(filepath.Join(archiveDir, "a.json"))
+	assert.Nil(err)
+	var a roomArchive
+	assert.Nil(json.Unmarshal(b, &a))
+	assert.Equal("a", a.Room)
+	assert.Len(a.Buyings, 1)
+	assert.Equal(map[string]string{strconv.FormatInt(reqTime, 10): "3"}, a.Que)
+
+	// 部屋を一通り見て回るものは片付けた部屋を作り直さない
+	assert.False(old.tryDo(func(s *roomState) {}))
+	n := 0
+	ac.eachRoom(func(s *roomState) { n++ })
+	assert.Equal(1, n)
+	ac.DumpFile()
+	assert.Len(ac.allRooms(), 1)
+
+	// 片付けられた部屋を掴んでいても作り直した部屋で動く
+	var que int
+	old.do(func(s *roomState) {
+		que = len(s.que)
+	})
+	assert.Equal(0, que)
+	assert.Len(ac.allRooms(), 2)
+
+	// 再起動しても戻ってこない
+	rb.unsubscribe(sub)
+	defer newTestCache(t, store, l)()
+	ac.room("a").do(func(s *roomState) {
+		que = len(s.que)
+	})
+	assert.Equal(0, que)
+	ac.room("b").do(func(s *roomState) {
+		que = len(s.que)
+	})
+	assert.Equal(1, que)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math/big"
+	"time"
+)
+
+// addIsu で受け付ける isu の桁数の上限
+const maxIsuDigits = 100
+
+// 1秒あたりに addIsu できる isu の上限。0 なら制限しない。
+// ISU_ADD_RATE は接続ごと、ISU_ROOM_ADD_RATE は部屋ごと
+var (
+	addRate     int64
+	roomAddRate int64
+)
+
+// 連打をためておけるのは何秒分までか
+const addBurstSeconds = 2
+
+// str2big と違い、読めない値は 0 にせずエラーにする
+func parseIsu(s string) (*big.Int, error) {
+	if len(s) > maxIsuDigits {
+		return nil, errTooLargeIsu
+	}
+	x, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, errInvalidIsu
+	}
+	if x.Sign() < 0 {
+		return nil, errNegativeIsu
+	}
+	return x, nil
+}
+
+// token bucket。1秒に rate isu ずつたまり、rate * addBurstSeconds より多くはたまらない。
+// 端数が出ないように中ではミリ椅子で数える
+type isuLimiter struct {
+	rate   *big.Int // 1ミリ秒にたまるミリ椅子 (= 1秒あたりの isu)
+	burst  *big.Int
+	tokens *big.Int
+	last   time.Time
+}
+
+// rate が 0 以下なら nil を返す。nil の limiter は何でも通す
+func newIsuLimiter(rate int64) *isuLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := big.NewInt(rate * addBurstSeconds * 1000)
+	return &isuLimiter{
+		rate:   big.NewInt(rate),
+		burst:  burst,
+		tokens: new(big.Int).Set(burst),
+	}
+}
+
+func (l *isuLimiter) allow(isu *big.Int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if l.last.IsZero() {
+		l.last = now
+	}
+	elapsed := now.Sub(l.last) / time.Millisecond
+	if elapsed > 0 {
+		l.tokens.Add(l.tokens, new(big.Int).Mul(l.rate, big.NewInt(int64(elapsed))))
+		if l.tokens.Cmp(l.burst) > 0 {
+			l.tokens.Set(l.burst)
+		}
+		l.last = l.last.Add(elapsed * time.Millisecond)
+	}
+	need := new(big.Int).Mul(isu, big.NewInt(1000))
+	if l.tokens.Cmp(need) < 0 {
+		return false
+	}
+	l.tokens.Sub(l.tokens, need)
+	return true
+}
+
+// allow で通したが使わなかった分を戻す
+func (l *isuLimiter) refund(isu *big.Int) {
+	if l == nil {
+		return
+	}
+	l.tokens.Add(l.tokens, new(big.Int).Mul(isu, big.NewInt(1000)))
+	if l.tokens.Cmp(l.burst) > 0 {
+		l.tokens.Set(l.burst)
+	}
+}
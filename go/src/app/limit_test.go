@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIsu(t *testing.T) {
+	assert := assert.New(t)
+
+	x, err := parseIsu("123")
+	assert.Nil(err)
+	assert.Equal(0, x.Cmp(big.NewInt(123)))
+	_, err = parseIsu("0")
+	assert.Nil(err)
+
+	for s, want := range map[string]error{
+		"":                                  errInvalidIsu,
+		"1e3":                               errInvalidIsu,
+		"abc":                               errInvalidIsu,
+		"-1":                                errNegativeIsu,
+		strings.Repeat("9", maxIsuDigits+1): errTooLargeIsu,
+	} {
+		_, err := parseIsu(s)
+		assert.Equal(want, err, s)
+	}
+}
+
+func TestIsuLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True((*isuLimiter)(nil).allow(big.NewInt(1000000), time.Now()))
+
+	// 1秒に 10 isu、20 isu までためられる
+	l := newIsuLimiter(10)
+	now := time.Now()
+	assert.True(l.allow(big.NewInt(15), now))
+	assert.False(l.allow(big.NewInt(6), now))
+	assert.True(l.allow(big.NewInt(5), now))
+
+	// 0.5ms ずつ進めても取りこぼさない
+	for i := 0; i < 200; i++ {
+		now = now.Add(500 * time.Microsecond)
+		l.allow(big.NewInt(0), now)
+	}
+	assert.True(l.allow(big.NewInt(1), now))
+	assert.False(l.allow(big.NewInt(1), now))
+
+	now = now.Add(time.Hour)
+	assert.False(l.allow(big.NewInt(21), now))
+	assert.True(l.allow(big.NewInt(20), now))
+}
+
+// 部屋ごとの制限は接続をまたいでかかる
+func TestRoomAddRate(t *testing.T) {
+	assert := assert.New(t)
+
+	r := setupRoom(nil)
+	r.limiter = newIsuLimiter(1)
+	reqTime := getCurrentTime() + 10000
+	assert.Nil(r.addIsuAt(big.NewInt(2), reqTime, nil))
+	assert.Equal(errRateLimited, r.addIsuAt(big.NewInt(1), reqTime, nil))
+}
+
+// 時刻が合わないものや部屋の制限にかかったものは接続の分を使わない
+func TestConnAddRate(t *testing.T) {
+	assert := assert.New(t)
+
+	r := setupRoom(nil)
+	conn := newIsuLimiter(1)
+	reqTime := getCurrentTime() + 10000
+	assert.Equal(errReqTimePast, r.addIsuAt(big.NewInt(2), getCurrentTime()-10000, conn))
+	r.limiter = newIsuLimiter(1)
+	r.limiter.tokens.SetInt64(0)
+	assert.Equal(errRateLimited, r.addIsuAt(big.NewInt(2), reqTime, conn))
+
+	r.limiter = nil
+	assert.Nil(r.addIsuAt(big.NewInt(2), reqTime, conn))
+	assert.Equal(errRateLimited, r.addIsuAt(big.NewInt(1), reqTime, conn))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 1行1 JSON のログ。部屋やリクエストの情報は with で field として付ける。
+// レベルなどは設定 (ISU_LOG_* など) か /admin/log で変えられる
+var logs = newLogger(os.Stderr)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLevel(s string) (int, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// logger は with で増やしても出力先と設定は共有する
+type logger struct {
+	out    *logOutput
+	fields []interface{} // key, value, key, value, ...
+}
+
+type logOutput struct {
+	mux *sync.Mutex
+	w   io.Writer
+	logConfig
+
+	// 1秒ごとに msg ごとの数を数え直す
+	window time.Time
+	counts map[string]int
+}
+
+// info 以下のメッセージは1秒に SampleFirst 件まで出し、それを超えたら SampleThereafter 件に1件だけ出す。
+// warn と error は間引かない
+type logConfig struct {
+	Level            string `json:"level"`
+	Format           string `json:"format"` // json か text
+	SampleFirst      int    `json:"sample_first"`
+	SampleThereafter int    `json:"sample_thereafter"`
+}
+
+func newLogger(w io.Writer) *logger {
+	return &logger{out: &logOutput{
+		mux: &sync.Mutex{},
+		w:   w,
+		logConfig: logConfig{
+			Level:            "info",
+			Format:           "json",
+			SampleFirst:      100,
+			SampleThereafter: 100,
+		},
+		counts: map[string]int{},
+	}}
+}
+
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{l.out, fields}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.write(levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.write(levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.write(levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.write(levelError, msg, kv) }
+
+func (l *logger) config() logConfig {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	return l.out.logConfig
+}
+
+// 空のものは変えない
+func (l *logger) setConfig(c logConfig) error {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	cur := l.out.logConfig
+	if c.Level != "" {
+		if _, err := parseLevel(c.Level); err != nil {
+			return err
+		}
+		cur.Level = strings.ToLower(c.Level)
+	}
+	switch c.Format {
+	case "":
+	case "json", "text":
+		cur.Format = c.Format
+	default:
+		return fmt.Errorf("unknown log format: %q", c.Format)
+	}
+	if c.SampleFirst < 0 || c.SampleThereafter < 0 {
+		return fmt.Errorf("sampling must not be negative")
+	}
+	if c.SampleFirst > 0 {
+		cur.SampleFirst = c.SampleFirst
+	}
+	if c.SampleThereafter > 0 {
+		cur.SampleThereafter = c.SampleThereafter
+	}
+	l.out.logConfig = cur
+	return nil
+}
+
+// mux を取ってから呼ぶこと
+func (o *logOutput) sampled(level int, msg string, now time.Time) bool {
+	if level >= levelWarn {
+		return true
+	}
+	if now.Sub(o.window) >= time.Second {
+		o.window = now
+		o.counts = map[string]int{}
+	}
+	o.counts[msg]++
+	n := o.counts[msg]
+	if n <= o.SampleFirst {
+		return true
+	}
+	return o.SampleThereafter > 0 && (n-o.SampleFirst)%o.SampleThereafter == 0
+}
+
+func (l *logger) write(level int, msg string, kv []interface{}) {
+	o := l.out
+	now := time.Now()
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	min, _ := parseLevel(o.Level)
+	if level < min || !o.sampled(level, msg, now) {
+		return
+	}
+
+	var b bytes.Buffer
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if o.Format == "text" {
+		fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006/01/02 15:04:05.000"), levelNames[level], msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", fields[i], logValue(fields[i+1]))
+		}
+	} else {
+		b.WriteString(`{"time":`)
+		writeJSONValue(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSONValue(&b, levelNames[level])
+		b.WriteString(`,"msg":`)
+		writeJSONValue(&b, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSONValue(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeJSONValue(&b, jsonLogValue(fields[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	o.w.Write(b.Bytes())
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// error や big.Int はそのままだと JSON で中身が見えないので文字列にする
+func jsonLogValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func logValue(v interface{}) string {
+	s := fmt.Sprint(jsonLogValue(v))
+	if strings.ContainsAny(s, " \"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// 標準の log に書かれたもの (ライブラリや log.Fatal) も error で出す。
+// 落ちる前の最後のメッセージのこともあるので、レベルでも間引きでも消さない
+type stdLogWriter struct {
+	l *logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.error(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// HTTP のアクセスログを logs に出す
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		logs.info("access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration_ms", float64(time.Since(start))/float64(time.Millisecond),
+			"remote", r.RemoteAddr)
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// WebSocket の Upgrade に要る
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack is not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// GET で今の設定、POST で変えたいものだけ送る
+func logConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var c logConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := logs.setConfig(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logs.info("log config is changed", "level", logs.config().Level)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs.config())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func logLines(b *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, s := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if s == "" {
+			continue
+		}
+		m := map[string]interface{}{}
+		json.Unmarshal([]byte(s), &m)
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestLoggerFields(t *testing.T) {
+	assert := assert.New(t)
+	var b bytes.Buffer
+	l := newLogger(&b)
+	rl := l.with("room", "a")
+	rl.with("request_id", 3).warn("rejected", "code", "not_enough", "err", errors.New("x"), "isu", big.NewInt(12))
+	rl.debug("hidden")
+
+	lines := logLines(&b)
+	assert.Len(lines, 1)
+	assert.Equal("warn", lines[0]["level"])
+	assert.Equal("rejected", lines[0]["msg"])
+	assert.Equal("a", lines[0]["room"])
+	assert.Equal(float64(3), lines[0]["request_id"])
+	assert.Equal("x", lines[0]["err"])
+	assert.Equal("12", lines[0]["isu"])
+
+	// with しても元の logger の field は変わらない
+	b.Reset()
+	rl.info("ok")
+	lines = logLines(&b)
+	assert.Nil(lines[0]["request_id"])
+
+	b.Reset()
+	assert.Nil(l.setConfig(logConfig{Level: "debug", Format: "text"}))
+	rl.debug("shown", "k", "a b")
+	assert.True(strings.HasSuffix(b.String(), ` debug shown room=a k="a b"`+"\n"), b.String())
+
+	assert.NotNil(l.setConfig(logConfig{Level: "verbose"}))
+	assert.NotNil(l.setConfig(logConfig{Format: "xml"}))
+	assert.Equal("debug", l.config().Level)
+}
+
+func TestLoggerSampling(t *testing.T) {
+	assert := assert.New(t)
+	var b bytes.Buffer
+	l := newLogger(&b)
+	assert.Nil(l.setConfig(logConfig{SampleFirst: 2, SampleThereafter: 3}))
+
+	o := l.out
+	now := time.Now()
+	got := []bool{}
+	for i := 0; i < 8; i++ {
+		got = append(got, o.sampled(levelInfo, "hot", now))
+	}
+	assert.Equal([]bool{true, true, false, false, true, false, false, true}, got)
+	// 別のメッセージと warn は間引かない
+	assert.True(o.sampled(levelInfo, "other", now))
+	assert.True(o.sampled(levelWarn, "hot", now))
+	// 1秒たったら数え直す
+	assert.True(o.sampled(levelInfo, "hot", now.Add(time.Second)))
+}
+
+func TestLogConfigHandler(t *testing.T) {
+	assert := assert.New(t)
+	old := logs
+	defer func() { logs = old }()
+	var b bytes.Buffer
+	logs = newLogger(&b)
+
+	w := httptest.NewRecorder()
+	logConfigHandler(w, httptest.NewRequest("POST", "/admin/log", strings.NewReader(`{"level":"warn"}`)))
+	assert.Equal(http.StatusOK, w.Code)
+	var c logConfig
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &c))
+	assert.Equal("warn", c.Level)
+	assert.Equal("json", c.Format)
+
+	w = httptest.NewRecorder()
+	logConfigHandler(w, httptest.NewRequest("POST", "/admin/log", strings.NewReader(`{"level":"loud"}`)))
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal("warn", logs.config().Level)
+}
+
+// 標準の log は warn にしていても出る
+func TestStdLogWriter(t *testing.T) {
+	assert := assert.New(t)
+	var b bytes.Buffer
+	l := newLogger(&b)
+	assert.Nil(l.setConfig(logConfig{Level: "error", SampleFirst: 1, SampleThereafter: 1000}))
+
+	w := stdLogWriter{l}
+	w.Write([]byte("listen tcp :5000: bind: address already in use\n"))
+	w.Write([]byte("listen tcp :5000: bind: address already in use\n"))
+	lines := logLines(&b)
+	assert.Len(lines, 2)
+	assert.Equal("error", lines[0]["level"])
+	assert.Equal("listen tcp :5000: bind: address already in use", lines[0]["msg"])
+}
+
+func TestAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	old := logs
+	defer func() { logs = old }()
+	var b bytes.Buffer
+	logs = newLogger(&b)
+
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/room/a", nil))
+	lines := logLines(&b)
+	assert.Len(lines, 1)
+	assert.Equal("access", lines[0]["msg"])
+	assert.Equal("GET", lines[0]["method"])
+	assert.Equal("/room/a", lines[0]["path"])
+	assert.Equal(float64(http.StatusTeapot), lines[0]["status"])
+	assert.Equal(float64(5), lines[0]["bytes"])
+}
@@ -3,15 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
-	"net/url"
-	"os"
+	"path/filepath"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
@@ -21,61 +18,71 @@ var (
 	db *sqlx.DB
 )
 
-var (
-	hostnames = []string{
-		"app0171.isu7f.k0y.org",
-		"app0172.isu7f.k0y.org",
-		"app0173.isu7f.k0y.org",
-	}
-)
-
-func getHostName(roomName string) string {
-	h := fnv.New32a()
-	h.Write([]byte(roomName))
-	return hostnames[h.Sum32()%3]
-}
-
 func initDB() {
-	db_host := os.Getenv("ISU_DB_HOST")
-	if db_host == "" {
-		db_host = "127.0.0.1"
-	}
-	db_port := os.Getenv("ISU_DB_PORT")
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := os.Getenv("ISU_DB_USER")
-	if db_user == "" {
-		db_user = "root"
-	}
-	db_password := os.Getenv("ISU_DB_PASSWORD")
-	if db_password != "" {
-		db_password = ":" + db_password
+	c := cfg.DB
+	password := ""
+	if c.Password != "" {
+		password = ":" + c.Password
 	}
 
 	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isudb?parseTime=true&loc=Local&charset=utf8mb4",
-		db_user, db_password, db_host, db_port)
+		c.User, password, c.Host, c.Port)
 
-	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
+	logs.info("connecting to db", "host", c.Host, "port", c.Port, "user", c.User)
+	var err error
+	db, err = sqlx.Open("mysql", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// つながるまでの様子は /healthz で見られる
 	for {
 		err := db.Ping()
+		health.setDB(err)
 		if err == nil {
 			break
 		}
-		log.Println(err)
+		logs.warn("failed to ping db", "err", err)
 		time.Sleep(time.Second * 3)
 	}
 
-	db.SetMaxOpenConns(20)
-	db.SetConnMaxLifetime(5 * time.Minute)
-	log.Printf("Succeeded to connect db.")
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime.Duration)
+	logs.info("connected to db")
+}
+
+func initStorage() {
+	kind, dir := cfg.Storage, cfg.DataDir
+
+	var err error
+	store, err = newStorage(kind, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var l *addingLog
+	if kind != "memory" {
+		l, err = openAddingLog(filepath.Join(dir, "adding.log"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ac, err = newAddingCache(store, l)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs.info("storage is ready", "kind", kind, "dir", dir)
+
+	archiveDir := ""
+	if kind != "memory" {
+		archiveDir = filepath.Join(dir, "archive")
+	}
+	ac.startSweeper(roomTTL, archiveDir)
 }
 
 func getInitializeHandler(w http.ResponseWriter, r *http.Request) {
-	db.MustExec("TRUNCATE TABLE adding")
-	db.MustExec("TRUNCATE TABLE buying")
-	db.MustExec("TRUNCATE TABLE room_time")
+	if err := store.Clean(); err != nil {
+		log.Panic(err)
+	}
 	ac.Clean()
 	w.WriteHeader(204)
 }
@@ -85,7 +92,11 @@ func getRoomHandler(w http.ResponseWriter, r *http.Request) {
 
 	roomName := vars["room_name"]
 	hostName := getHostName(roomName)
-	path := "/ws/" + url.PathEscape(roomName)
+	if hostName == "" {
+		http.Error(w, "no hosts available", http.StatusServiceUnavailable)
+		return
+	}
+	path := wsPath(roomName)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
@@ -101,28 +112,105 @@ func wsGameHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	roomName := vars["room_name"]
+	// 止めている間は断り、ロードバランサに別のサーバへ回してもらう
+	if !shutdown.enter() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// proxy で中継している間も止めるときに待つ
+	if forwardGameConn(w, r, roomName) {
+		shutdown.leave()
+		return
+	}
 
 	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("Failed to upgrade", err)
+		shutdown.leave()
+		logs.warn("failed to upgrade", "err", err)
 		return
 	}
-	go serveGameConn(ws, roomName)
+	go func() {
+		defer shutdown.leave()
+		serveGameConn(ws, roomName)
+	}()
 }
 
-func main() {
-	go http.ListenAndServe(":3000", nil)
-
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	initDB()
-
+// ゲームの listen に出すもの。管理用の API はここには置かない
+func newGameRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.HandleFunc("/healthz", getHealthzHandler)
+	r.HandleFunc("/readyz", getReadyzHandler)
+	r.HandleFunc("/metrics", getMetricsHandler).Methods("GET")
 	r.HandleFunc("/initialize", getInitializeHandler)
 	r.HandleFunc("/room/", getRoomHandler)
 	r.HandleFunc("/room/{room_name}", getRoomHandler)
 	r.HandleFunc("/ws/", wsGameHandler)
 	r.HandleFunc("/ws/{room_name}", wsGameHandler)
+	r.HandleFunc("/items", getItemsHandler).Methods("GET")
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../public/")))
+	return r
+}
+
+// pprof_listen に出すもの。/healthz と /readyz はゲームの方が立つ前から見られるようにする
+func newAdminRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", getHealthzHandler)
+	r.HandleFunc("/readyz", getReadyzHandler)
+	// 管理用の API は起動し終わるまで 503 を返す
+	admin := func(path string, f http.HandlerFunc) *mux.Route {
+		return r.Handle(path, waitStartup(f))
+	}
+	admin("/admin/items/reload", postItemsReloadHandler).Methods("POST")
+	admin("/admin/log", logConfigHandler).Methods("GET", "POST")
+	admin("/admin/hosts", getHostsHandler).Methods("GET")
+	admin("/admin/hosts/add", postHostsHandler("add")).Methods("POST")
+	admin("/admin/hosts/drain", postHostsHandler("drain")).Methods("POST")
+	admin("/admin/hosts/remove", postHostsHandler("remove")).Methods("POST")
+	admin("/admin/rooms/{room_name}/export", getRoomExportHandler).Methods("GET")
+	admin("/admin/rooms/{room_name}/import", postRoomImportHandler).Methods("POST")
+	admin("/admin/rooms/{room_name}/migrate", postRoomMigrateHandler).Methods("POST")
+	// 残りは net/http/pprof が登録した /debug/pprof/
+	r.NotFoundHandler = http.DefaultServeMux
+	return r
+}
+
+func main() {
+	// 標準の log (ライブラリや log.Fatal) も logs を通して出す
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logs})
+	initConfig()
+
+	// pprof の方に管理用の API も置く。ゲームの方からは見えない
+	if cfg.PprofListen != "" {
+		go http.ListenAndServe(cfg.PprofListen, newAdminRouter())
+	}
+
+	r := newGameRouter()
+
+	// replay が終わるまでは /readyz が 503 を返すので、先に listen しておく
+	srv := &http.Server{Addr: cfg.Listen, Handler: accessLog(waitStartup(r))}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	initStorage()
+
+	var err error
+	tracer, err = newExporter(cfg.Trace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := reloadItems(); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrecomputeItems >= 0 {
+		go precomputeItems(getItems(), cfg.PrecomputeItems)
+	}
 
-	log.Fatal(http.ListenAndServe(":5000", handlers.LoggingHandler(os.Stderr, r)))
+	health.setStarted()
+	logs.info("started", "addr", cfg.Listen)
+	waitSignal(srv, cfg.ShutdownTimeout.Duration)
 }
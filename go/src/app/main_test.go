@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// 管理用の API はゲームの listen には出さず、pprof_listen の方だけで受ける
+func TestAdminRoutesNotPublic(t *testing.T) {
+	assert := assert.New(t)
+	game := newGameRouter()
+	admin := newAdminRouter()
+
+	for _, c := range []struct{ method, path string }{
+		{"POST", "/admin/items/reload"},
+		{"GET", "/admin/log"},
+		{"POST", "/admin/log"},
+		{"GET", "/admin/hosts"},
+		{"POST", "/admin/hosts/add"},
+		{"POST", "/admin/hosts/drain"},
+		{"POST", "/admin/hosts/remove"},
+		{"GET", "/admin/rooms/a/export"},
+		{"POST", "/admin/rooms/a/import"},
+		{"POST", "/admin/rooms/a/migrate"},
+	} {
+		w := httptest.NewRecorder()
+		game.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		assert.Equal(http.StatusNotFound, w.Code, c.path)
+
+		var m mux.RouteMatch
+		admin.Match(httptest.NewRequest(c.method, c.path, nil), &m)
+		assert.NotNil(m.Route, c.path)
+	}
+}
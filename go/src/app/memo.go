@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+)
+
+// (cx+1)*d^(ax+b) の計算結果を覚えておく。
+// 同じ ItemID でも係数が違うことがある (テストやマスタの再読み込み) ので、係数ごと key にする
+type formulaKey struct {
+	a, b, c, d, x int64
+}
+
+type formulaMemo struct {
+	mux    *sync.RWMutex
+	values map[formulaKey]*big.Int
+	bytes  int // values が持っている big.Int の大きさの合計
+	limit  int // bytes がこれを超えたら全部捨てる
+}
+
+// 後ろの方の ordinal は1つで数MBになるので、個数ではなく大きさで制限する
+const formulaMemoLimit = 256 << 20
+
+var memo = newFormulaMemo(formulaMemoLimit)
+
+func newFormulaMemo(limit int) *formulaMemo {
+	return &formulaMemo{
+		mux:    &sync.RWMutex{},
+		values: make(map[formulaKey]*big.Int),
+		limit:  limit,
+	}
+}
+
+func calcFormula(k formulaKey) *big.Int {
+	s := big.NewInt(k.c*k.x + 1)
+	t := new(big.Int).Exp(big.NewInt(k.d), big.NewInt(k.a*k.x+k.b), nil)
+	return t.Mul(s, t)
+}
+
+// 返した値は他と共有しているので書き換えてはいけない
+func (m *formulaMemo) get(k formulaKey) *big.Int {
+	m.mux.RLock()
+	v, ok := m.values[k]
+	m.mux.RUnlock()
+	if ok {
+		return v
+	}
+
+	// 重い計算はロックの外でやる。同時に同じものを計算しても結果は同じ
+	v = calcFormula(k)
+	size := len(v.Bits()) * 8
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if size > m.limit {
+		return v
+	}
+	if m.bytes+size > m.limit {
+		m.values = make(map[formulaKey]*big.Int)
+		m.bytes = 0
+	}
+	if _, ok := m.values[k]; !ok {
+		m.values[k] = v
+		m.bytes += size
+	}
+	return v
+}
+
+// 起動時に count が 0..n の分を計算しておく
+func precomputeItems(items map[int]mItem, n int) {
+	for _, item := range items {
+		for x := 0; x <= n; x++ {
+			item.GetPower(x)
+			item.GetPrice(x)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormulaMemo(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newFormulaMemo(64)
+	item := defaultItems[13]
+	k := formulaKey{item.Price1, item.Price2, item.Price3, item.Price4, 10}
+
+	// 上限を超えるものは覚えない
+	v := m.get(k)
+	assert.Equal(0, v.Cmp(calcFormula(k)))
+	assert.Empty(m.values)
+
+	// 上限を超えそうになったら全部捨てる
+	for x := 0; x < 100; x++ {
+		m.get(formulaKey{0, 1, 0, 2, int64(x)})
+		assert.True(m.bytes <= m.limit)
+	}
+	assert.NotEmpty(m.values)
+	assert.True(len(m.values) < 100)
+}
+
+// defaultItems の全部について count = 1..10 を計算する
+func benchmarkFormula(b *testing.B, get func(formulaKey) interface{}) {
+	for i := 0; i < b.N; i++ {
+		for _, item := range defaultItems {
+			for x := 1; x <= 10; x++ {
+				get(formulaKey{item.Power1, item.Power2, item.Power3, item.Power4, int64(x)})
+				get(formulaKey{item.Price1, item.Price2, item.Price3, item.Price4, int64(x)})
+			}
+		}
+	}
+}
+
+func BenchmarkFormulaNoMemo(b *testing.B) {
+	benchmarkFormula(b, func(k formulaKey) interface{} { return calcFormula(k) })
+}
+
+func BenchmarkFormulaMemo(b *testing.B) {
+	m := newFormulaMemo(formulaMemoLimit)
+	benchmarkFormula(b, func(k formulaKey) interface{} { return m.get(k) })
+}
+
+func BenchmarkFormulaMemoParallel(b *testing.B) {
+	m := newFormulaMemo(formulaMemoLimit)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, item := range defaultItems {
+				m.get(formulaKey{item.Power1, item.Power2, item.Power3, item.Power4, 5})
+				m.get(formulaKey{item.Price1, item.Price2, item.Price3, item.Price4, 5})
+			}
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus の text format で /metrics に出す。
+// ラベルは少ないので、ラベルの値を \xff でつないだものをキーにする
+
+// 秒。calcStatus は数ms、DumpFile は部屋数次第で秒になる
+var defaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mux    *sync.Mutex
+	values map[string]float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mux     *sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // buckets ごと。累積ではない
+	sum    float64
+	count  uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name, help, labels, &sync.Mutex{}, map[string]float64{}}
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name, help, labels, defaultBuckets, &sync.Mutex{}, map[string]*histogram{}}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (c *counterVec) add(v float64, labels ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.values[labelKey(labels)] += v
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (h *histogramVec) observe(v float64, labels ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	k := labelKey(labels)
+	x, ok := h.values[k]
+	if !ok {
+		x = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = x
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		x.counts[i]++
+	}
+	x.sum += v
+	x.count++
+}
+
+func (h *histogramVec) since(start time.Time, labels ...string) {
+	h.observe(time.Since(start).Seconds(), labels...)
+}
+
+var (
+	metricActions = newCounterVec("isu_actions_total",
+		"GameRequest の数。result は success か error_code", "action", "result")
+	metricActionDuration = newHistogramVec("isu_action_duration_seconds",
+		"GameRequest を受けてから GameResponse を返すまで", "action")
+	metricCalcStatus = newHistogramVec("isu_calc_status_duration_seconds",
+		"calcStatus にかかった時間")
+	metricStatusDB = newHistogramVec("isu_get_status_db_duration_seconds",
+		"getStatus で buying と selling を読むのにかかった時間")
+	metricDump = newHistogramVec("isu_dump_duration_seconds",
+		"DumpFile にかかった時間")
+	metricDumpErrors = newCounterVec("isu_dump_errors_total",
+		"DumpFile の失敗")
+)
+
+// Prometheus の label value のエスケープ
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(k string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.SplitN(k, "\xff", n)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := map[string]bool{}
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(k, len(c.labels))), formatFloat(c.values[k]))
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := map[string]bool{}
+	for k := range h.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		x := h.values[k]
+		values := splitKey(k, len(h.labels))
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += x.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), x.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(x.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), x.count)
+	}
+}
+
+// host ラベルに使う名前。ring 上の名前がなければ hostname
+func metricHost() string {
+	if selfHost != "" {
+		return selfHost
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
+// 部屋ごとの値は取るときに集める
+func writeGauges(w io.Writer) {
+	fmt.Fprintf(w, "# HELP isu_websocket_connections 接続中の WebSocket の数\n# TYPE isu_websocket_connections gauge\n")
+	fmt.Fprintf(w, "isu_websocket_connections%s %d\n", formatLabels(nil, nil, "host", metricHost()), atomic.LoadInt64(&connCount))
+
+	if ac == nil {
+		return
+	}
+	que := map[string]int{}
+	ac.eachRoom(func(s *roomState) {
+		que[s.name] = len(s.que)
+	})
+	names := make([]string, 0, len(que))
+	for name := range que {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "# HELP isu_rooms 部屋の数\n# TYPE isu_rooms gauge\nisu_rooms %d\n", len(names))
+	fmt.Fprintf(w, "# HELP isu_room_queue_size total にまだまとめていない addIsu の数\n# TYPE isu_room_queue_size gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "isu_room_queue_size%s %d\n", formatLabels(nil, nil, "room", name), que[name])
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	metricActions.write(w)
+	metricActionDuration.write(w)
+	metricCalcStatus.write(w)
+	metricStatusDB.write(w)
+	metricDump.write(w)
+	metricDumpErrors.write(w)
+	writeGauges(w)
+}
+
+func getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	bw.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	assert := assert.New(t)
+	c := newCounterVec("test_total", "テスト", "action", "result")
+	c.inc("addIsu", "success")
+	c.inc("addIsu", "success")
+	c.inc("buyItem", `a"b`)
+
+	var b bytes.Buffer
+	c.write(&b)
+	assert.Equal(`# HELP test_total テスト
+# TYPE test_total counter
+test_total{action="addIsu",result="success"} 2
+test_total{action="buyItem",result="a\"b"} 1
+`, b.String())
+}
+
+func TestHistogramVec(t *testing.T) {
+	assert := assert.New(t)
+	h := newHistogramVec("test_seconds", "テスト")
+	h.buckets = []float64{0.1, 1}
+	h.observe(0.05)
+	h.observe(0.1)
+	h.observe(0.5)
+	h.observe(3)
+
+	var b bytes.Buffer
+	h.write(&b)
+	assert.Equal(`# HELP test_seconds テスト
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+`, b.String())
+}
+
+func TestWriteGauges(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	reqTime := getCurrentTime() + 10000
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), reqTime, nil) })
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), reqTime+1, nil) })
+	assert.Nil(err)
+	ac.room("b")
+
+	var b bytes.Buffer
+	writeGauges(&b)
+	out := b.String()
+	assert.True(strings.Contains(out, "isu_rooms 2\n"), out)
+	assert.True(strings.Contains(out, `isu_room_queue_size{room="a"} 2`+"\n"), out)
+	assert.True(strings.Contains(out, `isu_room_queue_size{room="b"} 0`+"\n"), out)
+	assert.True(strings.Contains(out, "isu_websocket_connections{host="), out)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 別のサーバに移すときに渡す部屋の中身
+type roomExport struct {
+	roomArchive
+	Time     int64           `json:"time"` // roomTime
+	Requests []exportRequest `json:"requests"`
+	// 移すたびに変える。同じ ID の import は2回目からは何もしない
+	ID string `json:"id,omitempty"`
+	// 今の中身を入れた import の ID。移す元が import できたかを確かめるのに使う
+	ImportedID string `json:"imported_id,omitempty"`
+}
+
+type exportRequest struct {
+	ClientID  string `json:"client_id"`
+	RequestID int    `json:"request_id"`
+}
+
+// 移した先を接続中のクライアントに教える。
+// クライアントは Host の Path につなぎ直す
+type reconnectHint struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	// ミリ秒。これだけ待ってからつなぎ直す
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+var migrateClient = &http.Client{Timeout: 10 * time.Second}
+
+// 別のサーバに移した部屋と、他のサーバから移してきた部屋。
+// 変えるときは先にログに書き、DumpFile でも書き直して再起動しても残るようにする
+var placements = newRoomPlacements()
+
+type roomPlacements struct {
+	mux      *sync.RWMutex
+	moved    map[string]string // 移した部屋と移し先。部屋が片付けられても覚えておく
+	imported map[string]string // 移してきた部屋と import の ID。ring の担当でなくてもこのサーバで受ける
+}
+
+func newRoomPlacements() *roomPlacements {
+	return &roomPlacements{
+		mux:      &sync.RWMutex{},
+		moved:    map[string]string{},
+		imported: map[string]string{},
+	}
+}
+
+func isImported(roomName string) bool {
+	placements.mux.RLock()
+	defer placements.mux.RUnlock()
+	_, ok := placements.imported[roomName]
+	return ok
+}
+
+func importedID(roomName string) string {
+	placements.mux.RLock()
+	defer placements.mux.RUnlock()
+	return placements.imported[roomName]
+}
+
+// 移していなければ空文字列
+func movedHost(roomName string) string {
+	placements.mux.RLock()
+	defer placements.mux.RUnlock()
+	return placements.moved[roomName]
+}
+
+// ログに書けたら覚える
+func (p *roomPlacements) set(l *addingLog, rec logRecord) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if err := l.Append(rec); err != nil {
+		return err
+	}
+	p.update(rec)
+	return nil
+}
+
+// ログを再生するときに使う
+func (p *roomPlacements) apply(rec logRecord) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.update(rec)
+}
+
+func (p *roomPlacements) update(rec logRecord) {
+	switch rec.Op {
+	case logOpMoved:
+		p.moved[rec.Room] = rec.Host
+		delete(p.imported, rec.Room)
+	case logOpImported:
+		p.imported[rec.Room] = rec.ID
+		delete(p.moved, rec.Room)
+	}
+}
+
+func (p *roomPlacements) clear() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.moved = map[string]string{}
+	p.imported = map[string]string{}
+}
+
+// 切り替えたばかりのログに今の状態を書き直す。
+// 書いている間は set を止めて、書き直したものが新しい変更より後ろに来ないようにする
+func (p *roomPlacements) appendTo(l *addingLog) error {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	for name, host := range p.moved {
+		if err := l.Append(logRecord{Op: logOpMoved, Room: name, Host: host}); err != nil {
+			return err
+		}
+	}
+	for name, id := range p.imported {
+		if err := l.Append(logRecord{Op: logOpImported, Room: name, ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csv では buying と selling を MySQL に置いていて、どのサーバからも同じものが見える
+func storeIsShared() bool {
+	_, ok := store.(*csvStorage)
+	return ok
+}
+
+func (s *roomState) export() (*roomExport, error) {
+	a, err := s.dump()
+	if err != nil {
+		return nil, err
+	}
+	e := &roomExport{roomArchive: *a, Time: s.time, Requests: []exportRequest{}, ImportedID: importedID(s.name)}
+	for _, k := range s.requests.keys {
+		e.Requests = append(e.Requests, exportRequest{k.clientID, k.requestID})
+	}
+	return e, nil
+}
+
+// 今の中身を捨てて e に置き換える。移す元が送り直してきたときは何もしない
+func (s *roomState) importFrom(e *roomExport) error {
+	if e.ID != "" && isImported(s.name) && importedID(s.name) == e.ID {
+		return nil
+	}
+	total, ok := new(big.Int).SetString(e.Total, 10)
+	if !ok {
+		return fmt.Errorf("invalid total: %q", e.Total)
+	}
+	que := map[int64]*big.Int{}
+	for k, v := range e.Que {
+		t, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return err
+		}
+		x, ok := new(big.Int).SetString(v, 10)
+		if !ok {
+			return fmt.Errorf("invalid que: %q", v)
+		}
+		que[t] = x
+	}
+
+	if !storeIsShared() {
+		if err := store.DropRoom(s.name); err != nil {
+			return err
+		}
+		// 売ったものは一度買ってから売り直す
+		for _, sale := range e.Sales {
+			if err := store.AddBuyings([]Buying{sale.buying()}); err != nil {
+				return err
+			}
+			if err := store.SellBuying(sale); err != nil {
+				return err
+			}
+		}
+		if len(e.Buyings) > 0 {
+			if err := store.AddBuyings(e.Buyings); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := placements.set(s.log, logRecord{Op: logOpImported, Room: s.name, ID: e.ID}); err != nil {
+		return err
+	}
+	s.reset()
+	s.movedTo = ""
+	s.time = e.Time
+	s.total = total
+	s.que = que
+	for _, r := range e.Requests {
+		s.requests.add(requestKey{r.ClientID, r.RequestID})
+	}
+
+	// 再生したときに前の中身が残らないように drop してから書く
+	s.appendLog(logRecord{Op: logOpDrop, Room: s.name})
+	s.appendLog(logRecord{Op: logOpFold, Room: s.name, Time: math.MinInt64, Isu: total.String()})
+	for t, v := range que {
+		s.appendLog(logRecord{Op: logOpAdd, Room: s.name, Time: t, Isu: v.String()})
+	}
+	return nil
+}
+
+// 移し終わった部屋を空にして、接続中のクライアントに移った先を教える。
+// movedTo は残るので、この後に来たリクエストは errRoomMoved になる
+func (s *roomState) handOff() {
+	s.appendLog(logRecord{Op: logOpDrop, Room: s.name})
+	if !storeIsShared() {
+		if err := store.DropRoom(s.name); err != nil {
+			s.lg.error("failed to drop moved room", "err", err)
+		}
+	}
+	if err := placements.set(s.log, logRecord{Op: logOpMoved, Room: s.name, Host: s.movedTo}); err != nil {
+		s.lg.error("failed to append log", "err", err)
+	}
+	movedTo := s.movedTo
+	s.reset()
+	s.movedTo = movedTo
+
+	hint := &reconnectHint{Host: movedTo, Path: wsPath(s.name)}
+	for sub := range s.subs {
+		sub.moveTo(hint)
+	}
+}
+
+// 移している間に来たリクエストは断る。queue に入ったものは全部 export に入る。
+// target は移し先の ring 上の名前、admin は移し先の pprof_listen のアドレス。
+// import できたかわからないときは移している途中のままにするので、同じ target でやり直す
+func migrateRoom(roomName, target, admin string) error {
+	r := ac.room(roomName)
+	var e *roomExport
+	var err error
+	r.do(func(s *roomState) {
+		if moved := movedHost(roomName); moved != "" {
+			err = fmt.Errorf("%s is already moved to %s", roomName, moved)
+			return
+		}
+		if s.movedTo != "" && s.movedTo != target {
+			err = fmt.Errorf("%s is being moved to %s", roomName, s.movedTo)
+			return
+		}
+		e, err = s.export()
+		if err == nil {
+			s.movedTo = target
+		}
+	})
+	if err != nil {
+		return err
+	}
+	e.ID = fmt.Sprintf("%s/%d", selfHost, time.Now().UnixNano())
+
+	if err := postImport(admin, e); err != nil {
+		// 送れていて返事だけ届かなかったこともあるので、移し先に確かめてから戻す
+		imported, cerr := confirmImport(admin, roomName, e.ID)
+		if cerr != nil {
+			return fmt.Errorf("%v (could not confirm the import, retry the migration: %v)", err, cerr)
+		}
+		if !imported {
+			r.do(func(s *roomState) {
+				s.movedTo = ""
+			})
+			return err
+		}
+		logs.warn("import succeeded despite the error", "room", roomName, "host", target, "err", err)
+	}
+
+	r.do(func(s *roomState) {
+		s.handOff()
+	})
+	logs.info("moved room", "room", roomName, "host", target)
+	return nil
+}
+
+// drain したこのサーバの部屋を ring の新しい担当に移す。admins は移し先の ring 上の名前 => pprof_listen
+func migrateDrainedRooms(admins map[string]string) error {
+	names := []string{}
+	ac.eachRoom(func(s *roomState) {
+		if s.movedTo == "" {
+			names = append(names, s.name)
+		}
+	})
+	errs := []string{}
+	for _, name := range names {
+		target := getHostName(name)
+		if target == "" || target == selfHost {
+			continue
+		}
+		admin, ok := admins[target]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: admin of %s is required", name, target))
+			continue
+		}
+		if err := migrateRoom(name, target, admin); err != nil {
+			errs = append(errs, name+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func postImport(admin string, e *roomExport) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	u := "http://" + admin + "/admin/rooms/" + url.PathEscape(e.Room) + "/import"
+	res, err := migrateClient.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("import to %s failed: %s %s", admin, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// 移し先の部屋が id の import で入れたものになっているか
+func confirmImport(admin, roomName, id string) (bool, error) {
+	res, err := migrateClient.Get("http://" + admin + "/admin/rooms/" + url.PathEscape(roomName) + "/export")
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("export from %s failed: %s", admin, res.Status)
+	}
+	var e roomExport
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		return false, err
+	}
+	return e.ImportedID == id, nil
+}
+
+func getRoomExportHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+	var e *roomExport
+	var err error
+	ac.room(roomName).do(func(s *roomState) {
+		e, err = s.export()
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+func postRoomImportHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+	var e roomExport
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Room != roomName {
+		http.Error(w, "room name mismatch", http.StatusBadRequest)
+		return
+	}
+	var err error
+	ac.room(roomName).do(func(s *roomState) {
+		err = s.importFrom(&e)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/rooms/{room_name}/migrate に {"host": "...", "admin": "..."} を送ると、その部屋を host に移す。
+// import は admin (host の pprof_listen) に送る
+func postRoomMigrateHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+	var req struct {
+		Host  string `json:"host"`
+		Admin string `json:"admin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Host == "" || req.Admin == "" {
+		http.Error(w, "host and admin are required", http.StatusBadRequest)
+		return
+	}
+	if err := migrateRoom(roomName, req.Host, req.Admin); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
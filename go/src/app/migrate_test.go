@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// 取り出した中身を別のストレージの部屋に入れると、前の中身は消えて同じ状態になる
+func TestRoomExportImport(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	src := newRoomState("m", nil)
+	src.time = 1000
+	src.total = big.NewInt(5000)
+	src.que[1500] = big.NewInt(3)
+	src.requests.add(requestKey{"c1", 7})
+	assert.Nil(store.AddBuyings([]Buying{{RoomName: "m", ItemID: 1, Ordinal: 1, Time: 900}}))
+
+	e, err := src.export()
+	assert.Nil(err)
+	b, err := json.Marshal(e)
+	assert.Nil(err)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var got roomExport
+	assert.Nil(json.Unmarshal(b, &got))
+	dst := newRoomState("m", l)
+	dst.appendLog(logRecord{Op: logOpAdd, Room: "m", Time: 1, Isu: "100"})
+	dst.que[1] = big.NewInt(100)
+	assert.Nil(dst.importFrom(&got))
+
+	assert.Equal(int64(1000), dst.time)
+	assert.Equal("5000", dst.total.String())
+	assert.Len(dst.que, 1)
+	assert.Equal("3", dst.que[1500].String())
+	assert.True(dst.requests.has(requestKey{"c1", 7}))
+	assert.True(isImported("m"))
+
+	// 同じ ID の import を送り直されても中身は変えない
+	got.ID = "x"
+	assert.Nil(dst.importFrom(&got))
+	dst.que[1500] = big.NewInt(4)
+	assert.Nil(dst.importFrom(&got))
+	assert.Equal("4", dst.que[1500].String())
+	e, err = dst.export()
+	assert.Nil(err)
+	assert.Equal("x", e.ImportedID)
+
+	buyings, err := store.Buyings("m")
+	assert.Nil(err)
+	assert.Len(buyings, 1)
+
+	// 再起動しても import した状態に戻る
+	defer newTestCache(t, store, l)()
+	ac.room("m").do(func(s *roomState) {
+		assert.Equal("5000", s.total.String())
+		assert.Len(s.que, 1)
+		assert.Equal("3", s.que[1500].String())
+	})
+	assert.True(isImported("m"))
+
+	// スナップショットを取って前のログを消しても、移してきたことは覚えている
+	assert.Nil(ac.DumpFile())
+	defer newTestCache(t, store, l)()
+	assert.True(isImported("m"))
+}
+
+func TestMigrateRoom(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	var err error
+
+	var imported roomExport
+	target := mux.NewRouter()
+	target.HandleFunc("/admin/rooms/{room_name}/import", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&imported)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(target)
+	defer ts.Close()
+	// import は移し先の管理用のアドレスに送り、クライアントにはゲームの方を教える
+	host := "b:5000"
+	admin := strings.TrimPrefix(ts.URL, "http://")
+
+	r := ac.room("a")
+	sub, _, err := r.subscribe()
+	assert.Nil(err)
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(42), getCurrentTime()+10000, nil) })
+	assert.Nil(err)
+
+	assert.Nil(migrateRoom("a", host, admin))
+	assert.Equal("a", imported.Room)
+	assert.Len(imported.Que, 1)
+
+	hint := <-sub.moved
+	assert.Equal(host, hint.Host)
+	assert.Equal(wsPath("a"), hint.Path)
+
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Equal(errRoomMoved, err)
+
+	// 後から来た接続にもすぐ移し先を教える
+	sub2, status, err := r.subscribe()
+	assert.Nil(err)
+	assert.Nil(status)
+	assert.Equal(host, (<-sub2.moved).Host)
+}
+
+// 移した元は再起動しても、部屋が片付けられても移し先を返す
+func TestMigrateRoomRestart(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	_, _, err := runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Nil(err)
+	assert.Nil(migrateRoom("a", "b:5000", strings.TrimPrefix(ts.URL, "http://")))
+	assert.Nil(ac.DumpFile())
+
+	defer newTestCache(t, store, l)()
+	assert.Equal("b:5000", movedHost("a"))
+	assert.False(isImported("a"))
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Equal(errRoomMoved, err)
+
+	assert.Equal(1, ac.sweep(time.Now().Add(time.Hour), ""))
+	ac.room("a").do(func(s *roomState) {
+		assert.Equal("b:5000", s.movedTo)
+		assert.Len(s.que, 0)
+	})
+}
+
+// 自分を drain すると、今ある部屋を ring の新しい担当に移す
+func TestDrainMigratesRooms(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+
+	var imported roomExport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&imported)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	defer func() {
+		ring = newHashRing(defaultHostnames)
+		selfHost = ""
+	}()
+	ring = newHashRing([]string{"a", "b"})
+	selfHost = "a"
+	name := ""
+	for i := 0; name == ""; i++ {
+		if n := "room" + strconv.Itoa(i); ring.get(n) == "a" {
+			name = n
+		}
+	}
+	_, _, err := runAction(name, nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Nil(err)
+
+	body := `{"host": "a", "admins": {"b": "` + strings.TrimPrefix(ts.URL, "http://") + `"}}`
+	w := httptest.NewRecorder()
+	postHostsHandler("drain")(w, httptest.NewRequest("POST", "/admin/hosts/drain", strings.NewReader(body)))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(name, imported.Room)
+	assert.Len(imported.Que, 1)
+	assert.Equal("b", movedHost(name))
+	assert.Equal("b", ring.get(name))
+
+	// 移し先の管理用のアドレスがわからなければ移さずにエラーにする
+	ring = newHashRing([]string{"a", "b"})
+	_, _, err = runAction("other", nil, requestKey{}, func(s *roomState) error { return nil })
+	assert.Nil(err)
+	w = httptest.NewRecorder()
+	postHostsHandler("drain")(w, httptest.NewRequest("POST", "/admin/hosts/drain", strings.NewReader(`{"host": "a"}`)))
+	assert.Equal(http.StatusBadGateway, w.Code)
+}
+
+// 移し先の代わり。import した ID を覚えていて export で返す
+type fakeTarget struct {
+	mux        *sync.Mutex
+	importedID string
+	importErr  bool          // import は受けたことにせず 500 を返す
+	exportErr  bool          // export に 500 を返す
+	delay      time.Duration // import してから返事をするまで待つ
+}
+
+func (f *fakeTarget) handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/rooms/{room_name}/import", func(w http.ResponseWriter, r *http.Request) {
+		var e roomExport
+		json.NewDecoder(r.Body).Decode(&e)
+		f.mux.Lock()
+		fail, delay := f.importErr, f.delay
+		if !fail {
+			f.importedID = e.ID
+		}
+		f.mux.Unlock()
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.HandleFunc("/admin/rooms/{room_name}/export", func(w http.ResponseWriter, r *http.Request) {
+		f.mux.Lock()
+		defer f.mux.Unlock()
+		if f.exportErr {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(roomExport{ImportedID: f.importedID})
+	})
+	return r
+}
+
+// import に失敗したことを確かめられたら、元の部屋でそのまま続ける
+func TestMigrateRoomFailed(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	var err error
+
+	target := &fakeTarget{mux: &sync.Mutex{}, importErr: true}
+	ts := httptest.NewServer(target.handler())
+	defer ts.Close()
+
+	reqTime := getCurrentTime() + 10000
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), reqTime, nil) })
+	assert.Nil(err)
+
+	err = migrateRoom("a", "b:5000", strings.TrimPrefix(ts.URL, "http://"))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "boom")
+
+	_, _, err = runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(2), reqTime, nil) })
+	assert.Nil(err)
+	ac.room("a").do(func(s *roomState) {
+		assert.Equal("3", s.que[reqTime].String())
+	})
+}
+
+// 返事が届かなくても移し先で import できていたら移したことにする。
+// 確かめられなければ移している途中のままにして、やり直せるようにする
+func TestMigrateRoomUnconfirmed(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	defer newTestCache(t, newMemoryStorage(), l)()
+	oldClient := migrateClient
+	defer func() { migrateClient = oldClient }()
+	migrateClient = &http.Client{Timeout: 100 * time.Millisecond}
+
+	target := &fakeTarget{mux: &sync.Mutex{}, delay: 300 * time.Millisecond}
+	ts := httptest.NewServer(target.handler())
+	defer ts.Close()
+	admin := strings.TrimPrefix(ts.URL, "http://")
+
+	assert.Nil(migrateRoom("a", "b:5000", admin))
+	assert.Equal("b:5000", movedHost("a"))
+
+	target.mux.Lock()
+	target.importErr, target.exportErr, target.delay = true, true, 0
+	target.mux.Unlock()
+	err := migrateRoom("c", "b:5000", admin)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "retry")
+	_, _, err = runAction("c", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Equal(errRoomMoved, err)
+	assert.NotNil(migrateRoom("c", "d:5000", admin))
+
+	target.mux.Lock()
+	target.importErr, target.exportErr = false, false
+	target.mux.Unlock()
+	assert.Nil(migrateRoom("c", "b:5000", admin))
+	assert.Equal("b:5000", movedHost("c"))
+}
+
+// /initialize したら移した部屋もこのサーバで受け直す
+func TestCleanMovedRoom(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	target := &fakeTarget{mux: &sync.Mutex{}}
+	ts := httptest.NewServer(target.handler())
+	defer ts.Close()
+
+	assert.Nil(migrateRoom("a", "b:5000", strings.TrimPrefix(ts.URL, "http://")))
+	ac.Clean()
+	assert.Equal("", movedHost("a"))
+	_, _, err := runAction("a", nil, requestKey{}, func(s *roomState) error { return s.addIsuAt(big.NewInt(1), getCurrentTime()+10000, nil) })
+	assert.Nil(err)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// このサーバの ring 上の名前 (ISU_SELF_HOST)。空なら担当を確かめずに全部の部屋を受け付ける
+var selfHost string
+
+// 担当でない部屋に来た接続をどうするか (ISU_NOT_OWNER)
+//
+//	reject (デフォルト): 421 と担当のホストを返す
+//	redirect:          担当のホストの /ws/ に 307 で飛ばす
+//	proxy:             担当のホストにつないで中継する
+//
+// ブラウザは WebSocket の 307 について行かず 421 の中身も読めないので、
+// reject と redirect では game.js が /room/ で担当を聞き直してつなぎ直す
+var notOwnerMode = "reject"
+
+// proxy で中継した接続に付ける。ring が食い違っていても中継を繰り返さないようにする
+const forwardedHeader = "X-Isu-Forwarded-By"
+
+// このサーバが受け持つなら空文字列、そうでなければ担当のホストを返す
+func roomOwner(roomName string) string {
+	if selfHost == "" || isImported(roomName) {
+		return ""
+	}
+	owner := getHostName(roomName)
+	if owner == selfHost {
+		return ""
+	}
+	return owner
+}
+
+func wsPath(roomName string) string {
+	return "/ws/" + url.PathEscape(roomName)
+}
+
+// 担当のサーバに任せたら true を返す
+func forwardGameConn(w http.ResponseWriter, r *http.Request, roomName string) bool {
+	owner := roomOwner(roomName)
+	if owner == "" {
+		return false
+	}
+	if by := r.Header.Get(forwardedHeader); by != "" {
+		logs.warn("forwarded room is not owned", "room", roomName, "from", by, "owner", owner)
+		rejectGameConn(w, roomName, owner)
+		return true
+	}
+
+	switch notOwnerMode {
+	case "redirect":
+		http.Redirect(w, r, "http://"+owner+wsPath(roomName), http.StatusTemporaryRedirect)
+	case "proxy":
+		proxyGameConn(w, r, roomName, owner)
+	default:
+		rejectGameConn(w, roomName, owner)
+	}
+	return true
+}
+
+// getRoomHandler と同じ形で担当のホストを返す
+func rejectGameConn(w http.ResponseWriter, roomName, owner string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(421) // Misdirected Request
+	json.NewEncoder(w).Encode(struct {
+		Host string `json:"host"`
+		Path string `json:"path"`
+	}{
+		Host: owner,
+		Path: wsPath(roomName),
+	})
+}
+
+func proxyGameConn(w http.ResponseWriter, r *http.Request, roomName, owner string) {
+	header := http.Header{}
+	header.Set(forwardedHeader, selfHost)
+	backend, _, err := websocket.DefaultDialer.Dial("ws://"+owner+wsPath(roomName), header)
+	if err != nil {
+		logs.warn("failed to connect to owner", "room", roomName, "owner", owner, "err", err)
+		http.Error(w, "owner is unavailable", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	if err != nil {
+		logs.warn("failed to upgrade", "err", err)
+		return
+	}
+	defer ws.Close()
+	atomic.AddInt64(&connCount, 1)
+	defer atomic.AddInt64(&connCount, -1)
+
+	// ws には止めるときにも書くので、書くのは1つずつにする
+	wmux := &sync.Mutex{}
+	// どちらかが切れたら両方閉じる
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src *websocket.Conn, dmux *sync.Mutex) {
+		defer func() { done <- struct{}{} }()
+		for {
+			mt, b, err := src.ReadMessage()
+			if err != nil {
+				return
+			}
+			dmux.Lock()
+			err = dst.WriteMessage(mt, b)
+			dmux.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+	go pipe(backend, ws, &sync.Mutex{})
+	go pipe(ws, backend, wmux)
+	select {
+	case <-done:
+	case <-shutdown.stopped():
+		// 中継しているこのサーバにつなぎ直してもらう。返事の来ていないリクエストはクライアントが送り直す
+		wmux.Lock()
+		err := closeForShutdown(ws, shutdownHint(r.Host, roomName))
+		wmux.Unlock()
+		if err != nil {
+			logs.info("failed to write", "room", roomName, "err", err)
+		}
+	}
+}
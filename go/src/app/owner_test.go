@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// 担当でない部屋への接続を reject, redirect, proxy する
+func TestForwardGameConn(t *testing.T) {
+	assert := assert.New(t)
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+
+	// 担当のサーバ
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("front", r.Header.Get(forwardedHeader))
+		ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		serveGameConn(ws, strings.TrimPrefix(r.URL.Path, "/ws/"))
+	}))
+	defer owner.Close()
+	ownerHost := strings.TrimPrefix(owner.URL, "http://")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/{room_name}", wsGameHandler)
+	front := httptest.NewServer(router)
+	defer front.Close()
+	frontURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/ws/a"
+
+	defer func() {
+		ring = newHashRing(defaultHostnames)
+		selfHost = ""
+		notOwnerMode = "reject"
+	}()
+	ring = newHashRing([]string{ownerHost})
+	selfHost = "front"
+
+	notOwnerMode = "reject"
+	_, res, err := websocket.DefaultDialer.Dial(frontURL, nil)
+	assert.NotNil(err)
+	assert.Equal(421, res.StatusCode)
+
+	notOwnerMode = "redirect"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.Get(front.URL + "/ws/a")
+	assert.Nil(err)
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode)
+	assert.Equal("http://"+ownerHost+"/ws/a", res.Header.Get("Location"))
+
+	notOwnerMode = "proxy"
+	ws, _, err := websocket.DefaultDialer.Dial(frontURL, nil)
+	assert.Nil(err)
+	defer ws.Close()
+
+	var status map[string]interface{}
+	assert.Nil(ws.ReadJSON(&status))
+	assert.Contains(status, "schedule")
+	reqTime := getCurrentTime() + 10000
+	assert.Nil(ws.WriteJSON(GameRequest{RequestID: 1, Action: "addIsu", Time: reqTime, Isu: "5"}))
+	for {
+		var m map[string]interface{}
+		assert.Nil(ws.ReadJSON(&m))
+		if _, ok := m["request_id"]; ok {
+			assert.Equal(true, m["is_success"])
+			break
+		}
+	}
+
+	// 担当のサーバの部屋に入っている
+	var total string
+	ac.room("a").do(func(s *roomState) {
+		total = s.que[reqTime].String()
+	})
+	assert.Equal(strconv.Itoa(5), total)
+}
@@ -0,0 +1,39 @@
+package main
+
+// 部屋ごとに覚えておくリクエストの数
+const maxRememberedRequests = 1024
+
+// request_id はクライアントごとに 1 から振り、つなぎ直しても続きから振る。
+// 別のクライアントとは重なるので client_id と組にして区別する。
+// つなぎ直したクライアントは、返事の来ていないリクエストを同じ組のまま送り直してくる
+type requestKey struct {
+	clientID  string
+	requestID int
+}
+
+// 最近成功したリクエスト。
+// 失敗したものは部屋の状態を変えていないので、送り直されたらもう一度実行すればよい
+type requestLog struct {
+	seen map[requestKey]bool
+	keys []requestKey // 古い順。maxRememberedRequests を超えたら先頭から忘れる
+}
+
+func newRequestLog() *requestLog {
+	return &requestLog{seen: make(map[requestKey]bool)}
+}
+
+func (l *requestLog) has(k requestKey) bool {
+	return l.seen[k]
+}
+
+func (l *requestLog) add(k requestKey) {
+	if l.seen[k] {
+		return
+	}
+	l.seen[k] = true
+	l.keys = append(l.keys, k)
+	if len(l.keys) > maxRememberedRequests {
+		delete(l.seen, l.keys[0])
+		l.keys = l.keys[1:]
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogBounded(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newRequestLog()
+	for i := 0; i < maxRememberedRequests+10; i++ {
+		l.add(requestKey{"c", i})
+	}
+	assert.Len(l.seen, maxRememberedRequests)
+	assert.False(l.has(requestKey{"c", 9}))
+	assert.True(l.has(requestKey{"c", 10}))
+	assert.True(l.has(requestKey{"c", maxRememberedRequests + 9}))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ISU_HOSTS を指定しないときのバックエンド
+var defaultHostnames = []string{
+	"app0171.isu7f.k0y.org",
+	"app0172.isu7f.k0y.org",
+	"app0173.isu7f.k0y.org",
+}
+
+// ホスト1台あたりの ring 上の点の数。多いほど部屋が均等に散らばる
+const ringVirtualNodes = 128
+
+var ring = newHashRing(defaultHostnames)
+
+// 部屋名からホストを決める consistent hashing の ring。
+// ホストを足したり抜いたりしても、動くのはそのホストの担当分の部屋だけになる
+type hashRing struct {
+	mux    *sync.RWMutex
+	hosts  map[string]bool // host => draining
+	points []ringPoint     // hash の順
+}
+
+type ringPoint struct {
+	hash uint32
+	host string
+}
+
+// 管理 API で返すホストの状態
+type ringHost struct {
+	Host     string `json:"host"`
+	Draining bool   `json:"draining"`
+}
+
+func fnv32a(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newHashRing(hosts []string) *hashRing {
+	r := &hashRing{
+		mux:   &sync.RWMutex{},
+		hosts: make(map[string]bool),
+	}
+	for _, h := range hosts {
+		r.hosts[h] = false
+	}
+	r.rebuild()
+	return r
+}
+
+// mux を取ってから呼ぶこと
+func (r *hashRing) rebuild() {
+	points := []ringPoint{}
+	for h, draining := range r.hosts {
+		if draining {
+			continue
+		}
+		for i := 0; i < ringVirtualNodes; i++ {
+			points = append(points, ringPoint{fnv32a(h + "#" + strconv.Itoa(i)), h})
+		}
+	}
+	// hash が衝突したときもどのプロセスでも同じ順になるように host でも並べる
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].host < points[j].host
+	})
+	r.points = points
+}
+
+// 担当のホストがいなければ空文字列を返す
+func (r *hashRing) get(roomName string) string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := fnv32a(roomName)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].host
+}
+
+// 新しいホストを足すか、drain 中のホストを戻す
+func (r *hashRing) add(host string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.hosts[host] = false
+	r.rebuild()
+}
+
+// 新しく部屋を割り当てないようにする。一覧には残る
+func (r *hashRing) drain(host string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.hosts[host]; !ok {
+		return fmt.Errorf("unknown host: %q", host)
+	}
+	r.hosts[host] = true
+	r.rebuild()
+	return nil
+}
+
+func (r *hashRing) remove(host string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.hosts[host]; !ok {
+		return fmt.Errorf("unknown host: %q", host)
+	}
+	delete(r.hosts, host)
+	r.rebuild()
+	return nil
+}
+
+func (r *hashRing) list() []ringHost {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	hosts := make([]ringHost, 0, len(r.hosts))
+	for h, draining := range r.hosts {
+		hosts = append(hosts, ringHost{h, draining})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// ISU_HOSTS はカンマ区切り
+func parseHosts(s string) []string {
+	hosts := []string{}
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func getHostName(roomName string) string {
+	return ring.get(roomName)
+}
+
+func getHostsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ring.list())
+}
+
+// POST /admin/hosts/{add,drain,remove} に {"host": "..."} を送る。
+// ring はプロセスごとに持っているので、全部のサーバに同じものを送ること。
+// drain は抜くサーバに先に送り、部屋を移し終えてから他のサーバに送る
+func postHostsHandler(op string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Host   string            `json:"host"`
+			Admins map[string]string `json:"admins"` // drain で部屋を移すときの移し先の pprof_listen
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Host == "" {
+			http.Error(w, "host is required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch op {
+		case "add":
+			ring.add(req.Host)
+		case "drain":
+			err = ring.drain(req.Host)
+			// 自分を抜くときは今ある部屋を新しい担当に移す。ring の違う他のサーバからも同じ所に行くようにする
+			if err == nil && req.Host == selfHost {
+				if err := migrateDrainedRooms(req.Admins); err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+		case "remove":
+			err = ring.remove(req.Host)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		getHostsHandler(w, r)
+	}
+}
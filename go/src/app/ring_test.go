@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ringAssign(r *hashRing, n int) map[string]string {
+	m := map[string]string{}
+	for i := 0; i < n; i++ {
+		name := "room" + strconv.Itoa(i)
+		m[name] = r.get(name)
+	}
+	return m
+}
+
+// ホストを足したり抜いたりしても、そのホストの担当分しか動かない
+func TestHashRing(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newHashRing([]string{"a", "b", "c"})
+	before := ringAssign(r, 3000)
+	count := map[string]int{}
+	for _, h := range before {
+		count[h]++
+	}
+	for _, h := range []string{"a", "b", "c"} {
+		assert.True(count[h] > 600, "%s: %d", h, count[h])
+	}
+
+	r.add("d")
+	added := ringAssign(r, 3000)
+	moved := 0
+	for name, h := range added {
+		if h != before[name] {
+			assert.Equal("d", h)
+			moved++
+		}
+	}
+	assert.True(moved > 300 && moved < 1200, "moved %d", moved)
+
+	assert.Nil(r.drain("b"))
+	drained := ringAssign(r, 3000)
+	for name, h := range drained {
+		assert.NotEqual("b", h)
+		if added[name] != "b" {
+			assert.Equal(added[name], h)
+		}
+	}
+	assert.Equal([]ringHost{{"a", false}, {"b", true}, {"c", false}, {"d", false}}, r.list())
+
+	// 戻せば元どおり
+	r.add("b")
+	assert.Equal(added, ringAssign(r, 3000))
+
+	assert.NotNil(r.drain("x"))
+	for _, h := range []string{"a", "b", "c", "d"} {
+		assert.Nil(r.remove(h))
+	}
+	assert.Equal("", r.get("room0"))
+
+	assert.Equal([]string{"a", "b"}, parseHosts(" a, ,b "))
+}
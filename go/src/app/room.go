@@ -0,0 +1,322 @@
+package main
+
+import (
+	"math/big"
+	"time"
+)
+
+// 接続中のクライアントに GameStatus を配る間隔
+var statusInterval = 500 * time.Millisecond
+
+// GameStatus で何ミリ秒先までシミュレーションするか。
+// これより前に追加された椅子はもう変わらないので total にまとめる
+var simulationWindow int64 = 1000
+
+// 部屋ごとの状態。その部屋の goroutine からしか触らないのでロックはいらない
+type roomState struct {
+	name  string
+	que   map[int64]*big.Int
+	total *big.Int
+	time  int64 // 最後に updateTime が成功した時刻
+	log   *addingLog
+	subs  map[*subscriber]bool
+	eco   *economy // nil なら次に使うときに store から読む
+
+	limiter  *isuLimiter // 部屋全体の addIsu の制限
+	requests *requestLog
+
+	active  time.Time // 最後に接続やリクエストがあった時刻
+	expired bool      // true になったら goroutine を終える
+	movedTo string    // 別のサーバに移している間と移した後は移し先のホスト
+
+	span *span   // 実行中の GameRequest の span。なければ nil
+	lg   *logger // 実行中の GameRequest があればその field も付いている
+}
+
+// 部屋に接続しているクライアント1つ分。
+// ch には最新の GameStatus だけが入り、読まれる前に次が来たら古い方を捨てる
+type subscriber struct {
+	ch    chan *GameStatus
+	moved chan *reconnectHint // 部屋が別のサーバに移ったら1回だけ入る
+}
+
+// 部屋ごとに goroutine を1つ立て、その部屋への操作は全部 ch 経由で順番に処理する
+type room struct {
+	name   string
+	ch     chan func(*roomState)
+	closed chan struct{} // 片付けられて goroutine が終わったら閉じる
+	cache  *AddingCache
+}
+
+func newRoomState(name string, l *addingLog) *roomState {
+	return &roomState{
+		name:  name,
+		que:   make(map[int64]*big.Int),
+		total: big.NewInt(0),
+		log:   l,
+		subs:  make(map[*subscriber]bool),
+
+		limiter:  newIsuLimiter(roomAddRate),
+		requests: newRequestLog(),
+		active:   time.Now(),
+		lg:       logs.with("room", name),
+	}
+}
+
+func startRoom(c *AddingCache, s *roomState) *room {
+	r := &room{
+		name:   s.name,
+		ch:     make(chan func(*roomState), 64),
+		closed: make(chan struct{}),
+		cache:  c,
+	}
+	go func() {
+		defer close(r.closed)
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case fn := <-r.ch:
+				fn(s)
+				if s.expired {
+					return
+				}
+			case <-ticker.C:
+				if len(s.subs) > 0 {
+					s.publish(nil)
+				}
+			}
+		}
+	}()
+	return r
+}
+
+// fn を部屋の goroutine で実行し、終わるまで待つ。
+// 部屋が片付けられていたら、同じ名前で作り直した部屋で実行する
+func (r *room) do(fn func(*roomState)) {
+	if !r.tryDo(fn) {
+		r.cache.reopen(r).do(fn)
+	}
+}
+
+// do と同じだが、片付けられていたら作り直さずに false を返す。
+// 部屋を一通り見て回るときに、片付けた部屋を空の部屋として生き返らせないように使う
+func (r *room) tryDo(fn func(*roomState)) bool {
+	done := make(chan struct{})
+	msg := func(s *roomState) {
+		defer close(done)
+		fn(s)
+	}
+	select {
+	case r.ch <- msg:
+	case <-r.closed:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-r.closed:
+		select {
+		case <-done:
+			// 片付ける前に実行されていた
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// 購読を始め、その時点の GameStatus を返す。
+// 部屋がもう移っていたら GameStatus は nil で、sub.moved に移し先が入る
+func (r *room) subscribe() (*subscriber, *GameStatus, error) {
+	sub := &subscriber{
+		ch:    make(chan *GameStatus, 1),
+		moved: make(chan *reconnectHint, 1),
+	}
+	var (
+		status *GameStatus
+		err    error
+	)
+	r.do(func(s *roomState) {
+		s.active = time.Now()
+		if s.movedTo != "" {
+			sub.moveTo(&reconnectHint{Host: s.movedTo, Path: wsPath(s.name)})
+			return
+		}
+		status, err = s.getStatus()
+		if err == nil {
+			s.subs[sub] = true
+		}
+	})
+	return sub, status, err
+}
+
+func (r *room) unsubscribe(sub *subscriber) {
+	r.do(func(s *roomState) {
+		s.active = time.Now()
+		delete(s.subs, sub)
+	})
+}
+
+// 受け手が遅くてもブロックしない。送るのは部屋の goroutine だけなので、このループはすぐ抜ける
+func (sub *subscriber) send(status *GameStatus) {
+	for {
+		select {
+		case sub.ch <- status:
+			return
+		default:
+		}
+		select {
+		case <-sub.ch:
+		default:
+		}
+	}
+}
+
+func (sub *subscriber) moveTo(hint *reconnectHint) {
+	select {
+	case sub.moved <- hint:
+	default:
+	}
+}
+
+// GameStatus を1回だけ計算して except 以外の購読者に配り、計算したものを返す。
+// except には自分で GameResponse の前に送りたい接続を渡す
+func (s *roomState) publish(except *subscriber) *GameStatus {
+	if except == nil && len(s.subs) == 0 {
+		return nil
+	}
+	status, err := s.getStatus()
+	if err != nil {
+		s.lg.error("failed to get status", "err", err)
+		return nil
+	}
+	for sub := range s.subs {
+		if sub != except {
+			sub.send(status)
+		}
+	}
+	return status
+}
+
+func (s *roomState) appendLog(rec logRecord) bool {
+	if err := s.log.Append(rec); err != nil {
+		s.lg.error("failed to append log", "err", err)
+		return false
+	}
+	return true
+}
+
+func (s *roomState) apply(rec logRecord) {
+	switch rec.Op {
+	case logOpAdd:
+		s.que[rec.Time] = str2big(rec.Isu)
+	case logOpFold:
+		for k := range s.que {
+			if k <= rec.Time {
+				delete(s.que, k)
+			}
+		}
+		s.total = str2big(rec.Isu)
+	default:
+		s.lg.warn("unknown log op", "op", rec.Op)
+	}
+}
+
+func (s *roomState) reset() {
+	s.que = make(map[int64]*big.Int)
+	s.total = big.NewInt(0)
+	s.time = 0
+	s.eco = nil
+	s.requests = newRequestLog()
+}
+
+func (s *roomState) loadEconomy() (*economy, error) {
+	if s.eco != nil {
+		return s.eco, nil
+	}
+	start := time.Now()
+	sp := s.startSpan("store.Buyings")
+	buyings, err := store.Buyings(s.name)
+	s.endSpan(sp, err)
+	if err != nil {
+		return nil, err
+	}
+	sp = s.startSpan("store.Sales")
+	sales, err := store.Sales(s.name)
+	s.endSpan(sp, err)
+	if err != nil {
+		return nil, err
+	}
+	metricStatusDB.since(start)
+	e := newEconomy(getItems(), buyings)
+	for _, sale := range sales {
+		e.buy(sale.buying())
+		e.sell(sale)
+	}
+	s.eco = e
+	return s.eco, nil
+}
+
+func (s *roomState) updateTime(reqTime int64) (int64, error) {
+	currentTime := getCurrentTime()
+	if currentTime < s.time {
+		s.lg.warn("room time is future", "room_time", s.time, "current_time", currentTime)
+		return 0, errRoomTimeFuture
+	}
+	if reqTime != 0 {
+		if reqTime < currentTime {
+			s.lg.warn("reqTime is past", "req_time", reqTime, "current_time", currentTime)
+			return 0, errReqTimePast
+		}
+	}
+	s.time = currentTime
+	return currentTime, nil
+}
+
+// ログに書けてから que を変える。失敗したときに送り直されても二重に足さない
+func (s *roomState) addIsu(reqIsu *big.Int, reqTime int64) bool {
+	v := new(big.Int).Set(reqIsu)
+	if cur, ok := s.que[reqTime]; ok {
+		v.Add(v, cur)
+	}
+	if !s.appendLog(logRecord{Op: logOpAdd, Room: s.name, Time: reqTime, Isu: v.String()}) {
+		return false
+	}
+	s.que[reqTime] = v
+	return true
+}
+
+// reqTime までに追加された椅子をミリ椅子で返す。
+// simulationWindow 以上前のものはもう変わらないので total にまとめておく
+func (s *roomState) getTotal(reqTime int64) *big.Int {
+	sp := s.startSpan("getTotal")
+	defer s.endSpan(sp, nil)
+	vs := make([]int64, 0, 0)
+	rest := new(big.Int)
+	for k, v := range s.que {
+		if k <= reqTime-simulationWindow {
+			s.total.Add(s.total, big.NewInt(0).Mul(v, big.NewInt(1000)))
+			vs = append(vs, k)
+		} else if k <= reqTime {
+			rest.Add(rest, big.NewInt(0).Mul(v, big.NewInt(1000)))
+		}
+	}
+	for _, k := range vs {
+		delete(s.que, k)
+	}
+	if len(vs) > 0 {
+		s.appendLog(logRecord{Op: logOpFold, Room: s.name, Time: reqTime - simulationWindow, Isu: s.total.String()})
+	}
+	return rest.Add(rest, s.total)
+}
+
+func (s *roomState) setAddingAt(currentTime int64, addingAt map[int64]Adding) {
+	for k, v := range s.que {
+		if k <= currentTime {
+			// 存在しないはず
+		} else {
+			addingAt[k] = Adding{s.name, k, v.String(), v}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SIGTERM を受けたら新しい接続を断り、今の接続には処理中のリクエストを返してから
+// つなぎ直すように伝えて切る。全部切れたら最後の DumpFile をして終わる
+var shutdown = newShutdownState()
+
+// 切るときに、クライアントがつなぎ直すまで待つ時間。再起動の間に来ても断られるだけなので少し待たせる
+const shutdownRetryAfter = 3 * time.Second
+
+type shutdownState struct {
+	mux      *sync.Mutex
+	stopping bool
+	conns    int           // 処理中の WebSocket の数
+	stop     chan struct{} // 止め始めたら閉じる
+	idle     chan struct{} // 止め始めて conns が 0 になったら閉じる
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{
+		mux:  &sync.Mutex{},
+		stop: make(chan struct{}),
+		idle: make(chan struct{}),
+	}
+}
+
+// 止め始めていたら false を返す。true のときは終わったら leave を呼ぶこと
+func (s *shutdownState) enter() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.conns++
+	return true
+}
+
+func (s *shutdownState) leave() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.conns--
+	if s.stopping && s.conns == 0 {
+		close(s.idle)
+	}
+}
+
+func (s *shutdownState) begin() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopping {
+		return
+	}
+	s.stopping = true
+	close(s.stop)
+	if s.conns == 0 {
+		close(s.idle)
+	}
+}
+
+// 止め始めたら閉じる channel
+func (s *shutdownState) stopped() <-chan struct{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stop
+}
+
+// テストで止める前に戻す
+func (s *shutdownState) reset() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.stopping = false
+	s.conns = 0
+	s.stop = make(chan struct{})
+	s.idle = make(chan struct{})
+}
+
+func (s *shutdownState) isStopping() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stopping
+}
+
+// 接続が全部切れるか ctx が終わるまで待つ
+func (s *shutdownState) wait(ctx context.Context) error {
+	s.mux.Lock()
+	idle := s.idle
+	s.mux.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 部屋の接続を切るときに送るもの。host (たいていは再起動したこのサーバ) に少し待ってからつなぎ直してもらう
+func shutdownHint(host, roomName string) *reconnectHint {
+	return &reconnectHint{
+		Host:       host,
+		Path:       wsPath(roomName),
+		RetryAfter: int64(shutdownRetryAfter / time.Millisecond),
+	}
+}
+
+// つなぎ直す先を送ってから close frame を送る
+func closeForShutdown(ws *websocket.Conn, hint *reconnectHint) error {
+	err := writeJSON(ws, struct {
+		Reconnect *reconnectHint `json:"reconnect"`
+	}{hint})
+	if err != nil {
+		return err
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	return ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+}
+
+// シグナルが来るまで待ってから止める。timeout を過ぎても残っている接続は待たずに DumpFile する
+func waitSignal(srv *http.Server, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	logs.info("shutting down", "signal", sig.String())
+	if err := gracefulShutdown(srv, timeout); err != nil {
+		logs.error("failed to shut down", "err", err)
+		os.Exit(1)
+	}
+	logs.info("stopped")
+	os.Exit(0)
+}
+
+func gracefulShutdown(srv *http.Server, timeout time.Duration) error {
+	health.setStopping()
+	shutdown.begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// listen をやめて、WebSocket 以外の処理中のリクエストを待つ
+	srvErr := make(chan error, 1)
+	go func() {
+		if srv == nil {
+			srvErr <- nil
+			return
+		}
+		srvErr <- srv.Shutdown(ctx)
+	}()
+	if err := shutdown.wait(ctx); err != nil {
+		logs.warn("some connections are still open", "err", err)
+	}
+	if err := <-srvErr; err != nil {
+		logs.warn("failed to stop server", "err", err)
+	}
+	if ac == nil {
+		return nil
+	}
+	return ac.Close()
+}
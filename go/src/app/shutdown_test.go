@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// 止めるときは処理中のリクエストを返し、つなぎ直す先と close frame を送ってから最後の DumpFile をする
+func TestGracefulShutdown(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "shutdown")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	kv, err := openKVStorage(filepath.Join(dir, "isu.kv"))
+	assert.Nil(err)
+	l, err := openAddingLog(filepath.Join(dir, "adding.log"))
+	assert.Nil(err)
+	defer newTestCache(t, kv, l)()
+
+	oldHealth := health
+	defer func() { health = oldHealth }()
+	defer shutdown.reset()
+	health = &healthState{mux: &sync.Mutex{}, startedAt: time.Now(), started: true}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/{room_name}", wsGameHandler)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/a"
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(err)
+	defer ws.Close()
+	var status map[string]interface{}
+	assert.Nil(ws.ReadJSON(&status))
+
+	reqTime := getCurrentTime() + 60000
+	assert.Nil(ws.WriteJSON(GameRequest{RequestID: 1, Action: "addIsu", Time: reqTime, Isu: "5"}))
+	for {
+		var m map[string]interface{}
+		assert.Nil(ws.ReadJSON(&m))
+		if _, ok := m["request_id"]; ok {
+			assert.Equal(true, m["is_success"])
+			break
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- gracefulShutdown(nil, 5*time.Second) }()
+
+	var res struct {
+		Reconnect *reconnectHint `json:"reconnect"`
+	}
+	for res.Reconnect == nil {
+		assert.Nil(ws.ReadJSON(&res))
+	}
+	assert.Equal("/ws/a", res.Reconnect.Path)
+	assert.Equal(int64(3000), res.Reconnect.RetryAfter)
+	_, _, err = ws.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	assert.Nil(<-done)
+	assert.Equal("not_ready", health.report(time.Now()).Status)
+
+	// 新しい接続は断る
+	_, r, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NotNil(err)
+	assert.Equal(http.StatusServiceUnavailable, r.StatusCode)
+
+	// 最後のスナップショットに que が残っていて、ログは空になっている
+	snap, err := kv.LoadAddings()
+	assert.Nil(err)
+	assert.Equal("5", snap.que["a"][reqTime].String())
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 0)
+}
+
+// 接続がなければすぐに終わる
+func TestGracefulShutdownIdle(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+
+	oldHealth := health
+	defer func() { health = oldHealth }()
+	defer shutdown.reset()
+	health = &healthState{mux: &sync.Mutex{}, startedAt: time.Now()}
+
+	assert.True(shutdown.enter())
+	shutdown.leave()
+	assert.Nil(gracefulShutdown(nil, time.Second))
+	assert.False(shutdown.enter())
+	assert.True(shutdown.isStopping())
+}
+
+// proxy で中継している接続も止めるときに待ち、中継しているサーバにつなぎ直してもらう
+func TestGracefulShutdownProxy(t *testing.T) {
+	assert := assert.New(t)
+	defer newTestCache(t, newMemoryStorage(), nil)()
+
+	oldHealth := health
+	defer func() { health = oldHealth }()
+	defer shutdown.reset()
+	health = &healthState{mux: &sync.Mutex{}, startedAt: time.Now(), started: true}
+
+	// 担当のサーバは受けたものを返すだけにしておく
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, b, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(mt, b)
+		}
+	}))
+	defer owner.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/{room_name}", wsGameHandler)
+	front := httptest.NewServer(router)
+	defer front.Close()
+	frontHost := strings.TrimPrefix(front.URL, "http://")
+
+	defer func() {
+		ring = newHashRing(defaultHostnames)
+		selfHost = ""
+		notOwnerMode = "reject"
+	}()
+	ring = newHashRing([]string{strings.TrimPrefix(owner.URL, "http://")})
+	selfHost = "front"
+	notOwnerMode = "proxy"
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+frontHost+"/ws/a", nil)
+	assert.Nil(err)
+	defer ws.Close()
+	assert.Nil(ws.WriteJSON(map[string]int{"ping": 1}))
+	var echo map[string]int
+	assert.Nil(ws.ReadJSON(&echo))
+	assert.Equal(1, echo["ping"])
+
+	done := make(chan error, 1)
+	go func() { done <- gracefulShutdown(nil, 5*time.Second) }()
+
+	var res struct {
+		Reconnect *reconnectHint `json:"reconnect"`
+	}
+	assert.Nil(ws.ReadJSON(&res))
+	assert.Equal(frontHost, res.Reconnect.Host)
+	assert.Equal("/ws/a", res.Reconnect.Path)
+	_, _, err = ws.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseGoingAway))
+	assert.Nil(<-done)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// AddingCache のスナップショットと buying の保存先
+type Storage interface {
+	LoadAddings() (*addingSnapshot, error)
+	SaveAddings(s *addingSnapshot) error
+
+	// ItemID, Ordinal の順に並べて返す
+	Buyings(roomName string) ([]Buying, error)
+	// 全部書くか何も書かないかのどちらか。
+	// 同じ (RoomName, ItemID, Ordinal) がすでにあれば errAlreadyBought を返す
+	AddBuyings(bs []Buying) error
+
+	// Time の順に並べて返す
+	Sales(roomName string) ([]Sale, error)
+	// (RoomName, ItemID, Ordinal) の buying を消して sale を記録する。
+	// buying がなければ errNotBought を返す
+	SellBuying(sale Sale) error
+
+	// 片付けた部屋の buying と sale を消す
+	DropRoom(roomName string) error
+
+	Clean() error
+}
+
+type addingSnapshot struct {
+	que   map[string]map[int64]*big.Int
+	total map[string]*big.Int
+}
+
+var (
+	store Storage
+)
+
+func newAddingSnapshot() *addingSnapshot {
+	return &addingSnapshot{
+		que:   make(map[string]map[int64]*big.Int),
+		total: make(map[string]*big.Int),
+	}
+}
+
+func (s *addingSnapshot) copy() *addingSnapshot {
+	c := newAddingSnapshot()
+	for name, v := range s.que {
+		for t, val := range v {
+			c.setQue(name, t, new(big.Int).Set(val))
+		}
+	}
+	for name, val := range s.total {
+		c.total[name] = new(big.Int).Set(val)
+	}
+	return c
+}
+
+func (s *addingSnapshot) setQue(roomName string, t int64, v *big.Int) {
+	if _, ok := s.que[roomName]; !ok {
+		s.que[roomName] = make(map[int64]*big.Int)
+	}
+	s.que[roomName][t] = v
+}
+
+// kind は ISU_STORAGE の値で csv (デフォルト), kv, memory のどれか
+func newStorage(kind, dir string) (Storage, error) {
+	switch kind {
+	case "", "csv":
+		initDB()
+		if _, err := db.Exec(createSellingTable); err != nil {
+			return nil, err
+		}
+		return &csvStorage{
+			quePath:   filepath.Join(dir, "que.csv"),
+			totalPath: filepath.Join(dir, "total.csv"),
+			db:        db,
+		}, nil
+	case "kv":
+		return openKVStorage(filepath.Join(dir, "isu.kv"))
+	case "memory":
+		return newMemoryStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown storage: %q", kind)
+}
+
+func sortSales(sales []Sale) {
+	sort.SliceStable(sales, func(i, j int) bool { return sales[i].Time < sales[j].Time })
+}
+
+func sortBuyings(buyings []Buying) {
+	sort.Slice(buyings, func(i, j int) bool {
+		if buyings[i].ItemID != buyings[j].ItemID {
+			return buyings[i].ItemID < buyings[j].ItemID
+		}
+		return buyings[i].Ordinal < buyings[j].Ordinal
+	})
+}
+
+// selling は後から足したテーブルなので、なければ作る
+const createSellingTable = `CREATE TABLE IF NOT EXISTS selling (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	room_name VARCHAR(191) NOT NULL,
+	item_id INT NOT NULL,
+	ordinal INT NOT NULL,
+	bought_time BIGINT NOT NULL,
+	time BIGINT NOT NULL,
+	refund TEXT NOT NULL,
+	INDEX (room_name)
+)`
+
+// 今までどおり que.csv, total.csv に書き出し、buying と selling は MySQL に置く
+type csvStorage struct {
+	quePath   string
+	totalPath string
+	db        *sqlx.DB
+}
+
+func readCSV(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	// ヘッダと中身で列の数が違う
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
+// que.csv と total.csv の1行目に置くヘッダ。
+// [snapshotMagic, バージョン, que か total, 世代] で、世代は同じ DumpFile で書いたものなら同じになる。
+// ヘッダのないファイルはバージョン 0 (ヘッダを足す前の形式) として読む
+const (
+	snapshotMagic   = "#isu-snapshot"
+	snapshotVersion = 1
+)
+
+type snapshotHeader struct {
+	version int
+	kind    string
+	gen     string
+}
+
+func (h snapshotHeader) record() []string {
+	return []string{snapshotMagic, strconv.Itoa(h.version), h.kind, h.gen}
+}
+
+// ヘッダを読んで取り除き、各行の列の数を確かめる
+func readSnapshotCSV(path, kind string, fields int) (snapshotHeader, [][]string, error) {
+	h := snapshotHeader{kind: kind}
+	records, err := readCSV(path)
+	if err != nil {
+		return h, nil, err
+	}
+	if len(records) > 0 && records[0][0] == snapshotMagic {
+		r := records[0]
+		if len(r) < 4 {
+			return h, nil, fmt.Errorf("%s: broken snapshot header", path)
+		}
+		h.version, err = strconv.Atoi(r[1])
+		if err != nil {
+			return h, nil, fmt.Errorf("%s: broken snapshot header: %v", path, err)
+		}
+		if h.version > snapshotVersion {
+			return h, nil, fmt.Errorf("%s: unsupported snapshot version %d", path, h.version)
+		}
+		if r[2] != kind {
+			return h, nil, fmt.Errorf("%s: snapshot is %q, not %q", path, r[2], kind)
+		}
+		h.gen = r[3]
+		records = records[1:]
+	}
+	for i, r := range records {
+		if len(r) != fields {
+			return h, nil, fmt.Errorf("%s: line %d has %d fields", path, i+1, len(r))
+		}
+	}
+	return h, records, nil
+}
+
+func (s *csvStorage) LoadAddings() (*addingSnapshot, error) {
+	snap := newAddingSnapshot()
+
+	queHeader, records, err := readSnapshotCSV(s.quePath, "que", 3)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		time, err := strconv.ParseInt(r[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		snap.setQue(r[0], time, str2big(r[2]))
+	}
+
+	totalHeader, records, err := readSnapshotCSV(s.totalPath, "total", 2)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		snap.total[r[0]] = str2big(r[1])
+	}
+
+	// 2つの rename の間で落ちた。.prev のログはまだ消していないので、再生すれば揃う
+	if queHeader.gen != totalHeader.gen {
+		logs.warn("que and total are from different snapshots", "que", queHeader.gen, "total", totalHeader.gen)
+	}
+	return snap, nil
+}
+
+// 部屋ごとに部屋の goroutine で集めた snap を書く。
+// que.csv と total.csv は別々に置き換えるので、どちらも書けてから DumpFile がログの .prev を消す
+func (s *csvStorage) SaveAddings(snap *addingSnapshot) error {
+	gen := strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := writeFileAtomic(s.quePath, func(w *csv.Writer) error {
+		if err := w.Write(snapshotHeader{snapshotVersion, "que", gen}.record()); err != nil {
+			return err
+		}
+		for name, v := range snap.que {
+			for time, val := range v {
+				if err := w.Write([]string{name, strconv.FormatInt(time, 10), val.String()}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.totalPath, func(w *csv.Writer) error {
+		if err := w.Write(snapshotHeader{snapshotVersion, "total", gen}.record()); err != nil {
+			return err
+		}
+		for name, val := range snap.total {
+			if err := w.Write([]string{name, val.String()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 一時ファイルに書いて fsync してから rename するので、読む側が書きかけのファイルを見ることはない。
+// rename もディレクトリを fsync するまでは落ちたときに消えることがある
+func writeFileAtomic(path string, fn func(w *csv.Writer) error) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	w := csv.NewWriter(f)
+	if err := fn(w); err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *csvStorage) Buyings(roomName string) ([]Buying, error) {
+	buyings := []Buying{}
+	err := s.db.Select(&buyings, "SELECT room_name, item_id, ordinal, time FROM buying WHERE room_name = ? ORDER BY item_id, ordinal", roomName)
+	return buyings, err
+}
+
+func (s *csvStorage) AddBuyings(bs []Buying) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, b := range bs {
+		_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", b.RoomName, b.ItemID, b.Ordinal, b.Time)
+		if err != nil {
+			tx.Rollback()
+			if me, ok := err.(*mysql.MySQLError); ok && me.Number == 1062 {
+				return errAlreadyBought
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *csvStorage) Sales(roomName string) ([]Sale, error) {
+	sales := []Sale{}
+	err := s.db.Select(&sales, "SELECT room_name, item_id, ordinal, bought_time, time, refund FROM selling WHERE room_name = ? ORDER BY time, id", roomName)
+	return sales, err
+}
+
+func (s *csvStorage) SellBuying(sale Sale) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM buying WHERE room_name = ? AND item_id = ? AND ordinal = ?", sale.RoomName, sale.ItemID, sale.Ordinal)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errNotBought
+	}
+	_, err = tx.Exec("INSERT INTO selling(room_name, item_id, ordinal, bought_time, time, refund) VALUES(?, ?, ?, ?, ?, ?)",
+		sale.RoomName, sale.ItemID, sale.Ordinal, sale.BoughtTime, sale.Time, sale.Refund)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *csvStorage) DropRoom(roomName string) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"buying", "selling"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE room_name = ?", roomName); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *csvStorage) Clean() error {
+	for _, table := range []string{"adding", "buying", "selling", "room_time"} {
+		if _, err := s.db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// テストや MySQL のない環境用。プロセスが落ちると全部消える
+type memoryStorage struct {
+	snap    *addingSnapshot
+	buyings map[string][]Buying
+	sales   map[string][]Sale
+	mux     *sync.Mutex
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		snap:    newAddingSnapshot(),
+		buyings: make(map[string][]Buying),
+		sales:   make(map[string][]Sale),
+		mux:     &sync.Mutex{},
+	}
+}
+
+func (s *memoryStorage) LoadAddings() (*addingSnapshot, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.snap.copy(), nil
+}
+
+func (s *memoryStorage) SaveAddings(snap *addingSnapshot) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.snap = snap
+	return nil
+}
+
+func (s *memoryStorage) Buyings(roomName string) ([]Buying, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	buyings := append([]Buying{}, s.buyings[roomName]...)
+	sortBuyings(buyings)
+	return buyings, nil
+}
+
+func (s *memoryStorage) AddBuyings(bs []Buying) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	seen := map[Buying]bool{}
+	for _, b := range bs {
+		k := Buying{RoomName: b.RoomName, ItemID: b.ItemID, Ordinal: b.Ordinal}
+		if seen[k] {
+			return errAlreadyBought
+		}
+		seen[k] = true
+		for _, x := range s.buyings[b.RoomName] {
+			if x.ItemID == b.ItemID && x.Ordinal == b.Ordinal {
+				return errAlreadyBought
+			}
+		}
+	}
+	for _, b := range bs {
+		s.buyings[b.RoomName] = append(s.buyings[b.RoomName], b)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Sales(roomName string) ([]Sale, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sales := append([]Sale{}, s.sales[roomName]...)
+	sortSales(sales)
+	return sales, nil
+}
+
+func (s *memoryStorage) SellBuying(sale Sale) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	buyings := s.buyings[sale.RoomName]
+	for i, b := range buyings {
+		if b.ItemID == sale.ItemID && b.Ordinal == sale.Ordinal {
+			s.buyings[sale.RoomName] = append(buyings[:i:i], buyings[i+1:]...)
+			s.sales[sale.RoomName] = append(s.sales[sale.RoomName], sale)
+			return nil
+		}
+	}
+	return errNotBought
+}
+
+func (s *memoryStorage) DropRoom(roomName string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.buyings, roomName)
+	delete(s.sales, roomName)
+	return nil
+}
+
+func (s *memoryStorage) Clean() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.snap = newAddingSnapshot()
+	s.buyings = make(map[string][]Buying)
+	s.sales = make(map[string][]Sale)
+	return nil
+}
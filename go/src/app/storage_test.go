@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kv に書いたものが開き直しても読める
+func TestKVStorage(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isu.kv")
+
+	s, err := openKVStorage(path)
+	assert.Nil(err)
+
+	snap := newAddingSnapshot()
+	snap.setQue("a", 100, big.NewInt(1))
+	snap.setQue("a", 200, big.NewInt(2))
+	snap.total["a"] = big.NewInt(3000)
+	assert.Nil(s.SaveAddings(snap))
+
+	snap = newAddingSnapshot()
+	snap.setQue("a", 200, big.NewInt(2))
+	snap.total["a"] = big.NewInt(4000)
+	assert.Nil(s.SaveAddings(snap))
+
+	assert.Nil(s.AddBuyings([]Buying{{RoomName: "a", ItemID: 2, Ordinal: 1, Time: 10}}))
+	assert.Nil(s.AddBuyings([]Buying{{RoomName: "a", ItemID: 1, Ordinal: 1, Time: 20}}))
+	assert.Equal(errAlreadyBought, s.AddBuyings([]Buying{{RoomName: "a", ItemID: 1, Ordinal: 1, Time: 30}}))
+	// 1つでも重複があれば何も書かない
+	assert.Equal(errAlreadyBought, s.AddBuyings([]Buying{
+		{RoomName: "a", ItemID: 3, Ordinal: 1, Time: 30},
+		{RoomName: "a", ItemID: 2, Ordinal: 1, Time: 30},
+	}))
+	assert.Nil(s.AddBuyings([]Buying{{RoomName: "a", ItemID: 3, Ordinal: 1, Time: 40}}))
+	sale := Sale{RoomName: "a", ItemID: 3, Ordinal: 1, BoughtTime: 40, Time: 50, Refund: "500"}
+	assert.Nil(s.SellBuying(sale))
+	assert.Equal(errNotBought, s.SellBuying(sale))
+
+	s, err = openKVStorage(path)
+	assert.Nil(err)
+
+	sales, err := s.Sales("a")
+	assert.Nil(err)
+	assert.Equal([]Sale{sale}, sales)
+
+	loaded, err := s.LoadAddings()
+	assert.Nil(err)
+	assert.Len(loaded.que["a"], 1)
+	assert.Equal(0, loaded.que["a"][200].Cmp(big.NewInt(2)))
+	assert.Equal(0, loaded.total["a"].Cmp(big.NewInt(4000)))
+
+	buyings, err := s.Buyings("a")
+	assert.Nil(err)
+	assert.Equal([]Buying{
+		{RoomName: "a", ItemID: 1, Ordinal: 1, Time: 20},
+		{RoomName: "a", ItemID: 2, Ordinal: 1, Time: 10},
+	}, buyings)
+
+	assert.Nil(s.Clean())
+	buyings, err = s.Buyings("a")
+	assert.Nil(err)
+	assert.Empty(buyings)
+}
+
+// 部屋の名前に区切りの \x00 が入っていても、他の部屋に混ざらず開き直しても読める
+func TestKVStorageRoomName(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isu.kv")
+
+	s, err := openKVStorage(path)
+	assert.Nil(err)
+	snap := newAddingSnapshot()
+	snap.setQue("a\x00x", 100, big.NewInt(1))
+	snap.total["a\x00x"] = big.NewInt(2)
+	assert.Nil(s.SaveAddings(snap))
+	assert.Nil(s.AddBuyings([]Buying{{RoomName: "a\x001\x007", ItemID: 2, Ordinal: 1, Time: 10}}))
+
+	s, err = openKVStorage(path)
+	assert.Nil(err)
+	loaded, err := s.LoadAddings()
+	assert.Nil(err)
+	assert.Equal("1", loaded.que["a\x00x"][100].String())
+	assert.Equal("2", loaded.total["a\x00x"].String())
+
+	buyings, err := s.Buyings("a")
+	assert.Nil(err)
+	assert.Empty(buyings)
+	buyings, err = s.Buyings("a\x001\x007")
+	assert.Nil(err)
+	assert.Equal([]Buying{{RoomName: "a\x001\x007", ItemID: 2, Ordinal: 1, Time: 10}}, buyings)
+}
+
+// que.csv と total.csv はヘッダ付きで書き、ヘッダのない前の形式も読める
+func TestCSVSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &csvStorage{quePath: filepath.Join(dir, "que.csv"), totalPath: filepath.Join(dir, "total.csv")}
+
+	snap := newAddingSnapshot()
+	snap.setQue("a", 100, big.NewInt(1))
+	snap.total["a"] = big.NewInt(3000)
+	snap.total["b,c"] = big.NewInt(5)
+	assert.Nil(s.SaveAddings(snap))
+
+	b, err := ioutil.ReadFile(s.quePath)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(string(b), "#isu-snapshot,1,que,"))
+	_, err = os.Stat(s.quePath + ".tmp")
+	assert.True(os.IsNotExist(err))
+
+	loaded, err := s.LoadAddings()
+	assert.Nil(err)
+	assert.Equal(0, loaded.que["a"][100].Cmp(big.NewInt(1)))
+	assert.Equal(0, loaded.total["a"].Cmp(big.NewInt(3000)))
+	assert.Equal(0, loaded.total["b,c"].Cmp(big.NewInt(5)))
+
+	// バージョン 0
+	assert.Nil(ioutil.WriteFile(s.quePath, []byte("a,200,2\n"), 0644))
+	assert.Nil(ioutil.WriteFile(s.totalPath, []byte("a,4000\n"), 0644))
+	loaded, err = s.LoadAddings()
+	assert.Nil(err)
+	assert.Equal(0, loaded.que["a"][200].Cmp(big.NewInt(2)))
+	assert.Equal(0, loaded.total["a"].Cmp(big.NewInt(4000)))
+
+	// 知らないバージョンや壊れた行は読まない
+	assert.Nil(ioutil.WriteFile(s.totalPath, []byte("#isu-snapshot,2,total,1\na,4000,x\n"), 0644))
+	_, err = s.LoadAddings()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "unsupported snapshot version 2")
+	assert.Nil(ioutil.WriteFile(s.totalPath, []byte("#isu-snapshot,1,que,1\n"), 0644))
+	_, err = s.LoadAddings()
+	assert.NotNil(err)
+	assert.Nil(ioutil.WriteFile(s.totalPath, []byte("#isu-snapshot,1,total,1\na\n"), 0644))
+	_, err = s.LoadAddings()
+	assert.NotNil(err)
+}
+
+// 書き直しに失敗しても書いたものは成功にし、次の write で書き直す
+func TestKVCompactFailure(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isu.kv")
+
+	kv, err := openKVFile(path)
+	assert.Nil(err)
+	kv.garbage = kvCompactThreshold + 1
+	// 一時ファイルを作れなくする
+	assert.Nil(os.Mkdir(path+".tmp", 0755))
+	assert.Nil(kv.Write([]kvOp{{Key: "a", Value: "1"}}))
+	assert.Equal(kvCompactThreshold+1, kv.garbage)
+	v, ok := kv.Get("a")
+	assert.True(ok)
+	assert.Equal("1", v)
+
+	assert.Nil(os.Remove(path + ".tmp"))
+	assert.Nil(kv.Write([]kvOp{{Key: "b", Value: "2"}}))
+	assert.Equal(0, kv.garbage)
+
+	kv, err = openKVFile(path)
+	assert.Nil(err)
+	v, _ = kv.Get("a")
+	assert.Equal("1", v)
+}
+
+// 書き直すときは小さなフレームに分け、読めないほど大きいものは書かない
+func TestKVFrameSize(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isu.kv")
+
+	ops := []kvOp{}
+	for i := 0; i < 100; i++ {
+		ops = append(ops, kvOp{Key: strconv.Itoa(i), Value: strings.Repeat("x", 100)})
+	}
+	frames, err := kvFrames(ops, 1000)
+	assert.Nil(err)
+	assert.True(len(frames) > 10, "%d frames", len(frames))
+	n := 0
+	for _, payload := range frames {
+		assert.True(len(payload) <= 1000)
+		var got []kvOp
+		assert.Nil(json.Unmarshal(payload, &got))
+		n += len(got)
+	}
+	assert.Equal(100, n)
+
+	kv, err := openKVFile(path)
+	assert.Nil(err)
+	assert.Nil(kv.Write(ops))
+	assert.Nil(kv.compact())
+	assert.Equal(errRecordTooLarge, kv.Write([]kvOp{{Key: "big", Value: strings.Repeat("x", logMaxRecord)}}))
+	_, ok := kv.Get("big")
+	assert.False(ok)
+
+	kv, err = openKVFile(path)
+	assert.Nil(err)
+	assert.Len(kv.data, 100)
+}
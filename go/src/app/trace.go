@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GameRequest ごとの処理を span に分けて記録する。
+// ISU_TRACE が空なら何もせず、span は全部 nil になる (nil の span のメソッドは何もしない)
+//
+//	file:/path/to/trace.jsonl  span を1行ずつ JSON で追記する
+//	http://host:port/path      trace ごとに span の配列を POST する
+var tracer spanExporter
+
+// GameRequest 1つ分の span を集め、最初の span が終わったらまとめて書き出す
+type trace struct {
+	id    string
+	mux   *sync.Mutex
+	spans []*spanData
+}
+
+type span struct {
+	trace  *trace
+	parent *span
+	data   *spanData
+}
+
+// OpenTelemetry の span に近い形にしておく
+type spanData struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_span_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      int64             `json:"start_time_unix_nano"`
+	End        int64             `json:"end_time_unix_nano"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type spanExporter interface {
+	export(spans []*spanData)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func startTrace(name string) *span {
+	if tracer == nil {
+		return nil
+	}
+	t := &trace{id: randomID(16), mux: &sync.Mutex{}}
+	return t.start(name, nil)
+}
+
+func (t *trace) start(name string, parent *span) *span {
+	sp := &span{t, parent, &spanData{
+		TraceID: t.id,
+		SpanID:  randomID(8),
+		Name:    name,
+		Start:   time.Now().UnixNano(),
+	}}
+	if parent != nil {
+		sp.data.ParentID = parent.data.SpanID
+	}
+	return sp
+}
+
+func (sp *span) child(name string) *span {
+	if sp == nil {
+		return nil
+	}
+	return sp.trace.start(name, sp)
+}
+
+func (sp *span) traceID() string {
+	if sp == nil {
+		return ""
+	}
+	return sp.trace.id
+}
+
+func (sp *span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	if sp.data.Attributes == nil {
+		sp.data.Attributes = map[string]string{}
+	}
+	switch v := value.(type) {
+	case string:
+		sp.data.Attributes[key] = v
+	default:
+		b, _ := json.Marshal(v)
+		sp.data.Attributes[key] = string(b)
+	}
+}
+
+// err が nil でなければ span に残す
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.data.Error = err.Error()
+}
+
+func (sp *span) end() {
+	if sp == nil {
+		return
+	}
+	sp.data.End = time.Now().UnixNano()
+	t := sp.trace
+	t.mux.Lock()
+	t.spans = append(t.spans, sp.data)
+	t.mux.Unlock()
+	if sp.parent == nil {
+		t.mux.Lock()
+		spans := t.spans
+		t.spans = nil
+		t.mux.Unlock()
+		tracer.export(spans)
+	}
+}
+
+type fileExporter struct {
+	mux *sync.Mutex
+	f   *os.File
+}
+
+func (e *fileExporter) export(spans []*spanData) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, s := range spans {
+		enc.Encode(s)
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if _, err := e.f.Write(b.Bytes()); err != nil {
+		logs.error("failed to write trace", "err", err)
+	}
+}
+
+// 送るのは別の goroutine で、詰まっていたら捨てる
+type httpExporter struct {
+	url string
+	ch  chan []*spanData
+}
+
+const traceQueueSize = 1024
+
+func newHTTPExporter(url string) *httpExporter {
+	e := &httpExporter{url, make(chan []*spanData, traceQueueSize)}
+	go func() {
+		client := &http.Client{Timeout: 5 * time.Second}
+		for spans := range e.ch {
+			b, _ := json.Marshal(spans)
+			res, err := client.Post(e.url, "application/json", bytes.NewReader(b))
+			if err != nil {
+				logs.error("failed to send trace", "err", err)
+				continue
+			}
+			res.Body.Close()
+		}
+	}()
+	return e
+}
+
+func (e *httpExporter) export(spans []*spanData) {
+	select {
+	case e.ch <- spans:
+	default:
+		logs.warn("trace queue is full")
+	}
+}
+
+func newExporter(s string) (spanExporter, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case strings.HasPrefix(s, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(s, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileExporter{&sync.Mutex{}, f}, nil
+	case strings.HasPrefix(s, "http://"), strings.HasPrefix(s, "https://"):
+		return newHTTPExporter(s), nil
+	}
+	return nil, fmt.Errorf("unknown ISU_TRACE: %q", s)
+}
+
+// 部屋の goroutine の中では s.span の下に span を作り、終わるまで s.span をそれにする
+func (s *roomState) startSpan(name string) *span {
+	sp := s.span.child(name)
+	if sp != nil {
+		s.span = sp
+	}
+	return sp
+}
+
+func (s *roomState) endSpan(sp *span, err error) {
+	if sp == nil {
+		return
+	}
+	sp.fail(err)
+	s.span = sp.parent
+	sp.end()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryExporter struct {
+	mux   *sync.Mutex
+	spans []*spanData
+}
+
+func (e *memoryExporter) export(spans []*spanData) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.spans = append(e.spans, spans...)
+}
+
+func (e *memoryExporter) byName() map[string]*spanData {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	m := map[string]*spanData{}
+	for _, s := range e.spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+func TestSpanNil(t *testing.T) {
+	tracer = nil
+	sp := startTrace("a")
+	assert.Nil(t, sp)
+	sp.set("k", 1)
+	sp.fail(errors.New("x"))
+	assert.Nil(t, sp.child("b"))
+	assert.Equal(t, "", sp.traceID())
+	sp.end()
+}
+
+// buyItem の中の span が親子になって、最初の span が終わったときにまとめて出る
+func TestTraceBuyItem(t *testing.T) {
+	assert := assert.New(t)
+	exp := &memoryExporter{mux: &sync.Mutex{}}
+	tracer = exp
+	defer func() { tracer = nil }()
+
+	defer newTestCache(t, newMemoryStorage(), nil)()
+	var err error
+	ac.room("a").do(func(s *roomState) {
+		s.total = big.NewInt(1000000000)
+	})
+
+	sub, _, err := ac.room("a").subscribe()
+	assert.Nil(err)
+
+	sp := startTrace("serveGameConn")
+	_, _, err = runTracedAction("a", sub, requestKey{}, sp, nil, func(s *roomState) error {
+		return s.buyItem(1, 0, 1, false, getCurrentTime()+1000)
+	})
+	assert.Nil(err)
+	assert.Empty(exp.byName())
+	sp.end()
+
+	spans := exp.byName()
+	for _, name := range []string{"serveGameConn", "room", "buyItem", "store.AddBuyings", "getStatus", "calcStatus", "getTotal"} {
+		if assert.Contains(spans, name) {
+			assert.Equal(sp.traceID(), spans[name].TraceID)
+			assert.True(spans[name].End >= spans[name].Start)
+		}
+	}
+	assert.Equal(spans["serveGameConn"].SpanID, spans["room"].ParentID)
+	assert.Equal(spans["room"].SpanID, spans["buyItem"].ParentID)
+	assert.Equal(spans["buyItem"].SpanID, spans["store.AddBuyings"].ParentID)
+	assert.Equal(spans["getStatus"].SpanID, spans["calcStatus"].ParentID)
+	assert.Equal("1", spans["buyItem"].Attributes["item_id"])
+}
+
+func TestTraceExporters(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "trace")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "trace.jsonl")
+	tracer, err = newExporter("file:" + path)
+	assert.Nil(err)
+	sp := startTrace("a")
+	sp.child("b").end()
+	sp.end()
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(lines, 2)
+	var d spanData
+	assert.Nil(json.Unmarshal([]byte(lines[1]), &d))
+	assert.Equal("a", d.Name)
+
+	got := make(chan []spanData, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []spanData
+		json.NewDecoder(r.Body).Decode(&spans)
+		got <- spans
+	}))
+	defer ts.Close()
+	tracer, err = newExporter(ts.URL)
+	assert.Nil(err)
+	startTrace("c").end()
+	select {
+	case spans := <-got:
+		assert.Len(spans, 1)
+		assert.Equal("c", spans[0].Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("trace is not sent")
+	}
+	tracer = nil
+
+	_, err = newExporter("udp://x")
+	assert.NotNil(err)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// AddingCache への変更を追記していく write-ahead log. nil のときは何もしない。
+//
+// 1レコードは [長さ uint32][crc32 uint32][JSON] で、値は差分ではなく適用後の値を持つ。
+// そのため古いスナップショットの上に同じレコードを重ねて再生しても結果は変わらない。
+type addingLog struct {
+	path string
+	f    *os.File
+	mux  *sync.Mutex
+	// 書きかけのフレームを消せなかったら true にして、その後ろには書かない
+	broken bool
+
+	// Append は fsync まで待つ。同時に来たものは1回の fsync にまとめる
+	syncMux *sync.Mutex
+	written int64 // 書いたレコードの数
+	synced  int64 // fsync 済みのレコードの数
+}
+
+const (
+	logOpAdd   = "add"   // que[Room][Time] = Isu
+	logOpFold  = "fold"  // que[Room] の Time 以下を捨て total[Room] = Isu
+	logOpClean = "clean" // 全部消す
+	logOpDrop  = "drop"  // Room を消す
+
+	logOpMoved    = "moved"    // Room を Host に移した
+	logOpImported = "imported" // Room を他のサーバから移してきた。ID は import の ID
+
+	logHeaderSize = 8
+	logMaxRecord  = 64 << 20
+)
+
+type logRecord struct {
+	Op   string `json:"op"`
+	Room string `json:"room,omitempty"`
+	Time int64  `json:"time,omitempty"`
+	Isu  string `json:"isu,omitempty"`
+	Host string `json:"host,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+var errTornRecord = errors.New("torn record")
+
+var errLogBroken = errors.New("log has a torn record that could not be removed")
+
+// 読むときに壊れたものとして捨てられてしまうので書かない
+var errRecordTooLarge = errors.New("record too large")
+
+func openAddingLog(path string) (*addingLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &addingLog{path: path, f: f, mux: &sync.Mutex{}, syncMux: &sync.Mutex{}}, nil
+}
+
+func (l *addingLog) prevPath() string {
+	return l.path + ".prev"
+}
+
+// [長さ uint32][crc32 uint32][payload] の1フレームを作る
+func encodeFrame(payload []byte) []byte {
+	buf := make([]byte, logHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[logHeaderSize:], payload)
+	return buf
+}
+
+// f の末尾に1フレーム書く。失敗したら書く前の長さに切り詰めて、途中まで書いたものを残さない。
+// 切り詰められなかったら errLogBroken を返すので、そのファイルにはもう書かないこと
+func appendFrame(f *os.File, payload []byte) error {
+	if len(payload) > logMaxRecord {
+		return errRecordTooLarge
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeFrame(payload)); err != nil {
+		if terr := f.Truncate(info.Size()); terr != nil {
+			logs.error("failed to remove torn record", "path", f.Name(), "err", err, "truncate_err", terr)
+			return errLogBroken
+		}
+		return err
+	}
+	return nil
+}
+
+// 書けなかったフレームは消すので、途中までしか書かれないのはプロセスが落ちたときの末尾の1レコードだけ。
+// fsync してから返すので、返ったものは電源が落ちても残る
+func (l *addingLog) Append(rec logRecord) error {
+	if l == nil {
+		return nil
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mux.Lock()
+	if l.broken {
+		l.mux.Unlock()
+		return errLogBroken
+	}
+	if err := appendFrame(l.f, payload); err != nil {
+		l.broken = err == errLogBroken
+		l.mux.Unlock()
+		return err
+	}
+	l.written++
+	n := l.written
+	l.mux.Unlock()
+	return l.syncTo(n)
+}
+
+// n 件目までが fsync されるまで待つ。
+// 他の部屋の fsync を待っている間に書かれたものは、次の1回でまとめて fsync する
+func (l *addingLog) syncTo(n int64) error {
+	l.syncMux.Lock()
+	defer l.syncMux.Unlock()
+	l.mux.Lock()
+	if l.synced >= n {
+		l.mux.Unlock()
+		return nil
+	}
+	target := l.written
+	l.mux.Unlock()
+
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.mux.Lock()
+	if target > l.synced {
+		l.synced = target
+	}
+	l.mux.Unlock()
+	return nil
+}
+
+func (l *addingLog) Sync() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.synced = l.written
+	return nil
+}
+
+// スナップショットを取る直前に呼ぶ。
+// 現在のログを .prev の後ろに移し、以降のレコードは空のログに書く。
+// .prev はスナップショットが書き終わるまで消さない。
+func (l *addingLog) Rotate() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.synced = l.written
+	cur, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	prev, err := os.OpenFile(l.prevPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(prev, cur); err != nil {
+		prev.Close()
+		return err
+	}
+	if err := prev.Sync(); err != nil {
+		prev.Close()
+		return err
+	}
+	if err := prev.Close(); err != nil {
+		return err
+	}
+	return l.f.Truncate(0)
+}
+
+// スナップショットが書けたら .prev はもういらない
+func (l *addingLog) Compact() error {
+	if l == nil {
+		return nil
+	}
+	err := os.Remove(l.prevPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// .prev, 現在のログの順に再生する
+func (l *addingLog) Replay(fn func(logRecord)) error {
+	if l == nil {
+		return nil
+	}
+	for _, path := range []string{l.prevPath(), l.path} {
+		err := replayFrames(path, func(payload []byte) error {
+			var rec logRecord
+			if err := json.Unmarshal(payload, &rec); err != nil {
+				return err
+			}
+			fn(rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 途中で壊れたフレームを見つけたらそこから後ろを切り捨てる。
+// fn がエラーを返したフレームも壊れているものとして扱う
+func replayFrames(path string, fn func(payload []byte) error) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		payload, n, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil && fn(payload) != nil {
+			err = errTornRecord
+		}
+		if err == errTornRecord {
+			logs.warn("discard torn record", "path", path, "offset", offset)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, logHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, n, errTornRecord
+	}
+	if err != nil {
+		return nil, n, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > logMaxRecord {
+		return nil, n, errTornRecord
+	}
+	payload := make([]byte, size)
+	m, err := io.ReadFull(r, payload)
+	n += m
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, n, errTornRecord
+	}
+	if err != nil {
+		return nil, n, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, n, errTornRecord
+	}
+	return payload, n, nil
+}
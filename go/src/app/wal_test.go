@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempLog(t *testing.T) (*addingLog, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := openAddingLog(filepath.Join(dir, "adding.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, func() { os.RemoveAll(dir) }
+}
+
+func replayAll(l *addingLog) ([]logRecord, error) {
+	recs := []logRecord{}
+	err := l.Replay(func(rec logRecord) {
+		recs = append(recs, rec)
+	})
+	return recs, err
+}
+
+// 末尾の書きかけのレコードは捨てられる
+func TestLogTornTail(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 1, Isu: "1"}))
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 2, Isu: "2"}))
+	info, _ := os.Stat(l.path)
+	good := info.Size()
+	assert.Nil(l.Append(logRecord{Op: logOpFold, Room: "a", Time: 2, Isu: "3000"}))
+	info, _ = os.Stat(l.path)
+	assert.Nil(os.Truncate(l.path, info.Size()-3))
+
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 2)
+	assert.Equal(logRecord{Op: logOpAdd, Room: "a", Time: 2, Isu: "2"}, recs[1])
+
+	info, _ = os.Stat(l.path)
+	assert.Equal(good, info.Size())
+
+	// 切り詰めたあとにも追記できる
+	assert.Nil(l.Append(logRecord{Op: logOpClean}))
+	recs, err = replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 3)
+	assert.Equal(logOpClean, recs[2].Op)
+}
+
+// 書けなかったレコードは数えず、消せなかったらそれより後ろには書かない
+func TestLogWriteFailure(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 1, Isu: "1"}))
+	good := l.f
+	// 読み込み専用では書けず、切り詰めることもできない
+	ro, err := os.Open(l.path)
+	assert.Nil(err)
+	defer ro.Close()
+	l.f = ro
+	assert.NotNil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 2, Isu: "2"}))
+	assert.True(l.broken)
+	assert.Equal(int64(1), l.written)
+
+	l.f = good
+	assert.Equal(errLogBroken, l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 3, Isu: "3"}))
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 1)
+}
+
+func TestLogChecksum(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 1, Isu: "1"}))
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 2, Isu: "2"}))
+
+	b, _ := ioutil.ReadFile(l.path)
+	b[len(b)-2] ^= 0xff
+	assert.Nil(ioutil.WriteFile(l.path, b, 0644))
+
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 1)
+}
+
+// Rotate 後も Compact するまでは .prev から再生できる
+func TestLogRotate(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 1, Isu: "1"}))
+	assert.Nil(l.Rotate())
+	assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: 2, Isu: "2"}))
+
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 2)
+
+	assert.Nil(l.Compact())
+	recs, err = replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 1)
+	assert.Equal(int64(2), recs[0].Time)
+}
+
+// ログに書けなかった addIsu は que に残さない
+func TestAddIsuLogFailure(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	s := newRoomState("a", l)
+	assert.True(s.addIsu(big.NewInt(3), 100))
+	l.f.Close()
+	assert.False(s.addIsu(big.NewInt(5), 100))
+	assert.False(s.addIsu(big.NewInt(5), 200))
+	assert.Equal("3", s.que[100].String())
+	assert.Len(s.que, 1)
+}
+
+// 並行に Append しても全部 fsync 済みになって返る
+func TestLogGroupCommit(t *testing.T) {
+	assert := assert.New(t)
+	l, done := tempLog(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(l.Append(logRecord{Op: logOpAdd, Room: "a", Time: int64(i), Isu: "1"}))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(int64(50), l.written)
+	assert.Equal(int64(50), l.synced)
+
+	recs, err := replayAll(l)
+	assert.Nil(err)
+	assert.Len(recs, 50)
+}
@@ -15,6 +15,18 @@ window.addEventListener("load", function() {
         13: "椅子神託",
     }
 
+    var xhr = new XMLHttpRequest();
+    xhr.responseType = 'json';
+    xhr.open("GET", "/items", true);
+    xhr.onload = function() {
+        if (xhr.status !== 200 || !xhr.response) return;
+        for (var i = 0; i < xhr.response.length; i++) {
+            var item = xhr.response[i];
+            if (item.name) ItemNames[item.item_id] = item.name;
+        }
+    };
+    xhr.send();
+
     var getClickListener = function(idx) {
         return function() {
             game.buy(idx);
@@ -196,7 +196,12 @@ var game = (function(){
         this.conn = null;
         this.isOpen = false;
         this.reqCount = 0;
+        // 送り直したリクエストをサーバが見分けられるように reqCount と組で送る
+        this.clientId = Math.random().toString(36).slice(2) + Date.now().toString(36);
         this.callbacks = {};
+        // 返事の来ていないリクエスト。つなぎ直したら同じ request_id のまま送り直す
+        this.pending = {};
+        this.closed = false;
         this.stateTime = null
         this.gameState = null;
         this.count_bought = null;
@@ -206,18 +211,40 @@ var game = (function(){
     }
     Room.prototype.connect = function(uri) {
         var self = this;
+        var opened = false;
         self.conn = new WebSocket(uri);
         self.conn.onopen = function() {
             console.log("onopen");
+            opened = true;
             self.isOpen = true;
+            // 一度実行されたものはサーバが client_id と request_id で見分けて実行し直さない
+            for (var id in self.pending) {
+                self.conn.send(JSON.stringify(self.pending[id]));
+            }
         }
         self.conn.onmessage = function(msg) {
             if (msg && msg.data) {
                 var res = JSON.parse(msg.data);
                 console.log(res);
-                if (res.request_id) {
-                    self.callbacks[res.request_id](res);
-                    self.callbacks[res.request_id] = null;
+                if (res.reconnect) {
+                    // 部屋が別のサーバに移ったか、サーバが再起動する。同じ clientId のままつなぎ直す
+                    self.conn.onclose = null;
+                    self.conn.close();
+                    self.isOpen = false;
+                    var uri = "ws://" + res.reconnect.host + res.reconnect.path;
+                    setTimeout(function() {
+                        self.connect(uri);
+                    }, res.reconnect.retry_after || 0);
+                } else if (res.request_id) {
+                    if (res.error_code === "room_moved") {
+                        // 移し先につないでから送り直す
+                        return;
+                    }
+                    delete self.pending[res.request_id];
+                    if (self.callbacks[res.request_id]) {
+                        self.callbacks[res.request_id](res);
+                        self.callbacks[res.request_id] = null;
+                    }
                 } else {
                     self.receiveData(res);
                 }
@@ -226,6 +253,14 @@ var game = (function(){
         self.conn.onclose = function() {
             console.log("onclose");
             self.isOpen = false;
+            if (!opened && !self.closed) {
+                // 担当でないサーバの 421 や 307 はブラウザからは見えないので、担当を聞き直してからつなぎ直す
+                setTimeout(function() {
+                    lookupRoom(self.name, function(addr) {
+                        self.connect(addr);
+                    });
+                }, 1000);
+            }
         }
         self.conn.onerror = function(err) {
             console.log("onerror", err);
@@ -254,10 +289,13 @@ var game = (function(){
         }
         var c = ++self.reqCount;
         req.request_id = c;
+        req.client_id = self.clientId;
         self.callbacks[c] = callback;
+        self.pending[c] = req;
         self.conn.send(JSON.stringify(req));
     }
     Room.prototype.close = function() {
+        this.closed = true;
         this.conn.close();
     }
     Room.prototype.getAddValue = function() {
@@ -321,10 +359,8 @@ var game = (function(){
     }
     var room = null;
 
-    var startGame = function(name) {
-        if (room != null) room.close();
-        room = null;
-
+    // /room/ で担当のサーバを聞いて、WebSocket のアドレスを callback に渡す
+    var lookupRoom = function(name, callback) {
         var xhr = new XMLHttpRequest();
         xhr.responseType = 'json';
         xhr.open("GET", "/room/" + encodeURIComponent(name), true);
@@ -335,15 +371,23 @@ var game = (function(){
                     if (host === "") {
                         host = location.host;
                     }
-                    var addr = "ws://" + host + this.response.path;
-                    room = new Room(name);
-                    room.connect(addr);
+                    callback("ws://" + host + this.response.path);
                 }
             }
         }
         xhr.send();
     }
 
+    var startGame = function(name) {
+        if (room != null) room.close();
+        room = null;
+
+        lookupRoom(name, function(addr) {
+            room = new Room(name);
+            room.connect(addr);
+        });
+    }
+
     return {
         "start": function(name) {
             startGame(name);